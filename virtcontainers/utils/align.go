@@ -0,0 +1,65 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+)
+
+// AlignRange shrinks the range of length bytes from offset to the largest
+// range within it whose offset and length are multiples of granularity,
+// e.g. the discard granularity of a device. The returned length is 0 when
+// no such range exists, see ValidateAlignedRange. A granularity of 0 or 1
+// leaves the range unchanged.
+func AlignRange(offset, length, granularity uint64) (uint64, uint64) {
+	if granularity <= 1 {
+		return offset, length
+	}
+
+	end := offset + length
+	if end < offset {
+		// Overflow, keep the range within the address space.
+		end = ^uint64(0)
+	}
+
+	alignedOffset := offset
+	if rem := offset % granularity; rem != 0 {
+		if alignedOffset+granularity-rem < alignedOffset {
+			return offset, 0
+		}
+		alignedOffset += granularity - rem
+	}
+
+	alignedEnd := end - end%granularity
+	if alignedEnd <= alignedOffset {
+		return alignedOffset, 0
+	}
+
+	return alignedOffset, alignedEnd - alignedOffset
+}
+
+// ValidateAlignedRange checks that the range of length bytes from offset is
+// not empty and that both offset and length are multiples of granularity,
+// as devices expect them for discard or direct I/O.
+func ValidateAlignedRange(offset, length, granularity uint64) error {
+	if length == 0 {
+		return fmt.Errorf("Empty range at offset %d, it might be smaller than the granularity %d", offset, granularity)
+	}
+
+	if granularity <= 1 {
+		return nil
+	}
+
+	if offset%granularity != 0 {
+		return fmt.Errorf("Offset %d is not aligned to %d", offset, granularity)
+	}
+
+	if length%granularity != 0 {
+		return fmt.Errorf("Length %d is not aligned to %d", length, granularity)
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlignRange(t *testing.T) {
+	assert := assert.New(t)
+
+	max := ^uint64(0)
+
+	tests := []struct {
+		offset, length, granularity  uint64
+		alignedOffset, alignedLength uint64
+	}{
+		{0, 4096, 4096, 0, 4096},
+		{0, 10000, 4096, 0, 8192},
+		{1, 10000, 4096, 4096, 4096},
+		{100, 200, 0, 100, 200},
+		{100, 200, 1, 100, 200},
+		{1, 4096, 4096, 4096, 0},
+		{4095, 2, 4096, 4096, 0},
+		{0, 100, 4096, 0, 0},
+		{0, 0, 4096, 0, 0},
+		{3, 30, 10, 10, 20},
+		{max - 10, 100, 4096, 0, 0},
+	}
+
+	for _, test := range tests {
+		offset, length := AlignRange(test.offset, test.length, test.granularity)
+		assert.Equal(test.alignedLength, length, "%+v", test)
+		if test.alignedLength != 0 {
+			assert.Equal(test.alignedOffset, offset, "%+v", test)
+			assert.NoError(ValidateAlignedRange(offset, length, test.granularity))
+		} else {
+			assert.Error(ValidateAlignedRange(offset, length, test.granularity))
+		}
+	}
+}
+
+func TestValidateAlignedRange(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(ValidateAlignedRange(4096, 8192, 4096))
+	assert.NoError(ValidateAlignedRange(1, 3, 0))
+	assert.Error(ValidateAlignedRange(0, 0, 4096))
+	assert.Error(ValidateAlignedRange(0, 0, 0))
+	assert.Error(ValidateAlignedRange(512, 4096, 4096))
+	assert.Error(ValidateAlignedRange(4096, 512, 4096))
+}
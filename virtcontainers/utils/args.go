@@ -0,0 +1,57 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// shellSignificantChars are the characters rejected by ValidateArgument.
+// Backslashes are allowed, udev escapes spaces as \x20 in the names of the
+// links in /dev/disk/by-label and /dev/disk/by-partlabel.
+const shellSignificantChars = "`$&|;<>(){}[]*?!~#'\""
+
+// ErrUnsafeArgument is returned when an externally sourced value is not
+// safe to pass as an argument to an external tool.
+type ErrUnsafeArgument struct {
+	// Name describes the argument, e.g. "label".
+	Name string
+
+	// Value is the rejected value.
+	Value string
+
+	// Reason tells why Value was rejected.
+	Reason string
+}
+
+func (e *ErrUnsafeArgument) Error() string {
+	return fmt.Sprintf("Unsafe %s %q: %s", e.Name, e.Value, e.Reason)
+}
+
+// ValidateArgument checks that value, named name in errors, can be passed
+// as an argument to tools like mkfs or e2label. Tools are run without a
+// shell, but a value starting with a dash would still be parsed as an
+// option, so such values are rejected along with control and shell
+// significant characters. An empty value is valid, e.g. to clear a label.
+func ValidateArgument(name, value string) error {
+	if strings.HasPrefix(value, "-") {
+		return &ErrUnsafeArgument{name, value, "it looks like an option"}
+	}
+
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return &ErrUnsafeArgument{name, value, "it contains control characters"}
+		}
+
+		if strings.ContainsRune(shellSignificantChars, r) {
+			return &ErrUnsafeArgument{name, value, fmt.Sprintf("it contains %q", r)}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateArgument(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, value := range []string{"", "scratch", "my label", "data_01", "/dev/disk/by-path/pci-0000:00:1f.2-ata-1", "/dev/disk/by-label/EFI\\x20System", "système"} {
+		assert.NoError(ValidateArgument("label", value), "%q", value)
+	}
+
+	for _, value := range []string{
+		"-f",
+		"--force",
+		"-O^has_journal",
+		"data;reboot",
+		"$(reboot)",
+		"`reboot`",
+		"a|b",
+		"a&b",
+		"a>b",
+		"a\nb",
+		"a\x00b",
+		"a\tb",
+		"it's",
+		"*",
+	} {
+		err := ValidateArgument("label", value)
+		assert.Error(err, "%q", value)
+
+		unsafe, ok := err.(*ErrUnsafeArgument)
+		assert.True(ok)
+		assert.Equal("label", unsafe.Name)
+		assert.Equal(value, unsafe.Value)
+		assert.NotEmpty(unsafe.Reason)
+	}
+}
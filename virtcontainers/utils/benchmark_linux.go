@@ -0,0 +1,163 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// benchmarkAlignment is the alignment of the buffers, offsets and sizes of
+// the O_DIRECT requests issued by QuickDeviceBenchmark, a multiple of any
+// logical block size.
+const benchmarkAlignment = 4096
+
+// DeviceBenchmarkOptions describes how QuickDeviceBenchmarkWithOptions
+// measures the throughput of a device.
+type DeviceBenchmarkOptions struct {
+	// Write enables the write test, which overwrites the scratch region
+	// of the device with random data.
+	//
+	// WARNING: this destroys the data in the scratch region.
+	Write bool
+
+	// ScratchOffset is the offset of the scratch region, whose size is
+	// the sample size. It must be a multiple of 4096 bytes.
+	ScratchOffset int64
+}
+
+// QuickDeviceBenchmark measures the sequential read throughput of the block
+// device disk, in bytes per second, by reading its first sampleBytes
+// bytes, see QuickDeviceBenchmarkWithOptions. Nothing is written, the write
+// throughput returned is 0.
+func QuickDeviceBenchmark(disk string, sampleBytes int64) (float64, float64, error) {
+	return QuickDeviceBenchmarkWithOptions(disk, sampleBytes, DeviceBenchmarkOptions{})
+}
+
+// QuickDeviceBenchmarkWithOptions measures the sequential read throughput,
+// and the write throughput if opts.Write is set, of the block device disk
+// in bytes per second, as a quick health check of the storage. sampleBytes
+// are read from the start of disk, then written to the scratch region,
+// sampleBytes must be a multiple of 4096 bytes. O_DIRECT is used when
+// available so that the page cache does not make up the numbers. They
+// remain a rough estimate: a single sequential stream over a small sample
+// says little about the throughput under load.
+//
+// The write test refuses the root device, see IsRootDevice, and a device
+// that is mounted, or any of its partitions, or that is held by another
+// device, e.g. device mapper.
+//
+// WARNING: the write test destroys the data in the scratch region.
+func QuickDeviceBenchmarkWithOptions(disk string, sampleBytes int64, opts DeviceBenchmarkOptions) (readBytesPerSec, writeBytesPerSec float64, err error) {
+	if sampleBytes <= 0 || sampleBytes%benchmarkAlignment != 0 {
+		return 0, 0, fmt.Errorf("Invalid sample size %d, it must be a positive multiple of %d", sampleBytes, benchmarkAlignment)
+	}
+
+	if opts.ScratchOffset < 0 || opts.ScratchOffset%benchmarkAlignment != 0 {
+		return 0, 0, fmt.Errorf("Invalid scratch offset %d, it must be a multiple of %d", opts.ScratchOffset, benchmarkAlignment)
+	}
+
+	var f *os.File
+	if opts.Write {
+		f, err = openUnusedBlockDevice(disk, "write to", os.O_RDWR|syscall.O_DIRECT)
+	} else {
+		f, err = openBlockDeviceDirect(disk, os.O_RDONLY)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	size, err := blockDeviceSize(f)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if uint64(sampleBytes) > size {
+		return 0, 0, fmt.Errorf("Sample size %d is larger than %v of %d bytes", sampleBytes, disk, size)
+	}
+
+	if opts.Write && uint64(opts.ScratchOffset) > size-uint64(sampleBytes) {
+		return 0, 0, fmt.Errorf("Scratch region %d+%d does not fit in %v of %d bytes", opts.ScratchOffset, sampleBytes, disk, size)
+	}
+
+	chunkSize := capRequestSize(f, disk, regionChunkSize) &^ (benchmarkAlignment - 1)
+	if chunkSize == 0 {
+		chunkSize = benchmarkAlignment
+	}
+	buf := alignedBuffer(int(chunkSize), benchmarkAlignment)
+
+	readBytesPerSec, err = timeChunks(sampleBytes, int64(len(buf)), func(pos, n int64) error {
+		if _, err := f.ReadAt(buf[:n], pos); err != nil {
+			return fmt.Errorf("Could not read %v at %d: %v", disk, pos, err)
+		}
+		return nil
+	})
+	if err != nil || !opts.Write {
+		return readBytesPerSec, 0, err
+	}
+
+	if _, err := rand.Read(buf); err != nil {
+		return 0, 0, err
+	}
+
+	writeBytesPerSec, err = timeChunks(sampleBytes, int64(len(buf)), func(pos, n int64) error {
+		if _, err := f.WriteAt(buf[:n], opts.ScratchOffset+pos); err != nil {
+			return fmt.Errorf("Could not write to %v at %d: %v", disk, opts.ScratchOffset+pos, err)
+		}
+
+		// The last write is only done once it reaches the device.
+		if pos+n == sampleBytes {
+			return f.Sync()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return readBytesPerSec, writeBytesPerSec, nil
+}
+
+// alignedBuffer returns a buffer of size bytes whose address is a multiple
+// of alignment, as O_DIRECT requires.
+func alignedBuffer(size, alignment int) []byte {
+	buf := make([]byte, size+alignment)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(alignment)); rem != 0 {
+		shift = alignment - rem
+	}
+
+	return buf[shift : shift+size]
+}
+
+// timeChunks calls fn for every chunk of at most chunkSize bytes of the
+// total bytes, in order, and returns the throughput in bytes per second.
+func timeChunks(total, chunkSize int64, fn func(pos, n int64) error) (float64, error) {
+	start := time.Now()
+
+	for pos := int64(0); pos < total; pos += chunkSize {
+		n := chunkSize
+		if n > total-pos {
+			n = total - pos
+		}
+
+		if err := fn(pos, n); err != nil {
+			return 0, err
+		}
+	}
+
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond.Seconds()
+	}
+
+	return float64(total) / elapsed, nil
+}
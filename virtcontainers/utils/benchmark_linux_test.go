@@ -0,0 +1,81 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuickDeviceBenchmark(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "benchmark")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+	assert.NoError(f.Truncate(1 << 20))
+	f.Close()
+
+	// Not a block device
+	_, _, err = QuickDeviceBenchmark(f.Name(), 4096)
+	assert.Error(err)
+
+	for _, sampleBytes := range []int64{-4096, 0, 4095} {
+		_, _, err = QuickDeviceBenchmark(f.Name(), sampleBytes)
+		assert.Error(err, "sample size %d", sampleBytes)
+	}
+
+	loop, cleanup := setupLoopDevice(t, 8<<20)
+	defer cleanup()
+
+	read, write, err := QuickDeviceBenchmark(loop, 4<<20)
+	assert.NoError(err)
+	assert.True(read > 0)
+	assert.Zero(write)
+
+	_, _, err = QuickDeviceBenchmark(loop, 16<<20)
+	assert.Error(err)
+
+	// Only the scratch region is overwritten.
+	read, write, err = QuickDeviceBenchmarkWithOptions(loop, 1<<20, DeviceBenchmarkOptions{
+		Write:         true,
+		ScratchOffset: 4 << 20,
+	})
+	assert.NoError(err)
+	assert.True(read > 0)
+	assert.True(write > 0)
+
+	data, err := ioutil.ReadFile(loop)
+	assert.NoError(err)
+	zeroes := make([]byte, 1<<20)
+	assert.Equal(zeroes, data[3<<20:4<<20])
+	assert.False(bytes.Equal(zeroes, data[4<<20:5<<20]))
+	assert.Equal(zeroes, data[5<<20:6<<20])
+
+	for _, offset := range []int64{-4096, 1, 8 << 20, 8<<20 - 4096} {
+		_, _, err = QuickDeviceBenchmarkWithOptions(loop, 1<<20, DeviceBenchmarkOptions{Write: true, ScratchOffset: offset})
+		assert.Error(err, "offset %d", offset)
+	}
+}
+
+func TestQuickDeviceBenchmarkMounted(t *testing.T) {
+	assert := assert.New(t)
+
+	loop, _, cleanup := setupMountedLoopDevice(t, 16<<20, "ext4")
+	defer cleanup()
+
+	read, _, err := QuickDeviceBenchmark(loop, 1<<20)
+	assert.NoError(err)
+	assert.True(read > 0)
+
+	_, _, err = QuickDeviceBenchmarkWithOptions(loop, 1<<20, DeviceBenchmarkOptions{Write: true, ScratchOffset: 8 << 20})
+	assert.Error(err)
+	assert.Contains(err.Error(), "mounted")
+}
@@ -0,0 +1,778 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sectorSize is the unit of the sizes reported by BLKGETSIZE and by the
+// block layer in sysfs, whatever the logical block size of the device.
+const sectorSize = 512
+
+// sysfsRoot is the path where sysfs is mounted.
+var sysfsRoot = "/sys"
+
+var zramDeviceRegex = regexp.MustCompile(`^zram[0-9]+$`)
+
+var opticalDeviceRegex = regexp.MustCompile(`^(sr|scd)[0-9]+$`)
+
+const (
+	// scsiTypeROM is the SCSI peripheral device type of CD/DVD drives,
+	// see <scsi/scsi_proto.h>
+	scsiTypeROM = "5"
+
+	// genhdFlagCD is the GENHD_FL_CD capability flag, reported by kernels
+	// older than 5.17.
+	genhdFlagCD = 0x8
+)
+
+// GetBlockDeviceSize returns the size in bytes of the block device disk.
+// It relies on BLKGETSIZE64 and falls back to BLKGETSIZE on kernels or
+// drivers that do not support it.
+func GetBlockDeviceSize(disk string) (uint64, error) {
+	f, err := os.Open(disk)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return blockDeviceSize(f)
+}
+
+func blockDeviceSize(f *os.File) (uint64, error) {
+	var size uint64
+
+	err := ioctlFunc(f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	if err == nil {
+		return size, nil
+	}
+
+	if errno := ioctlErrno(err); errno != syscall.ENOTTY && errno != syscall.EINVAL {
+		return 0, err
+	}
+
+	// BLKGETSIZE returns the number of 512 bytes sectors in an
+	// unsigned long.
+	var sectors uintptr
+	if err := ioctlFunc(f.Fd(), unix.BLKGETSIZE, uintptr(unsafe.Pointer(&sectors))); err != nil {
+		return 0, err
+	}
+
+	return uint64(sectors) * sectorSize, nil
+}
+
+// blockDeviceReadOnly returns true if f is a block device set read-only
+// in the kernel. It returns false for other files.
+func blockDeviceReadOnly(f *os.File) (bool, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return false, nil
+	}
+
+	var ro int32
+	if err := ioctlFunc(f.Fd(), unix.BLKROGET, uintptr(unsafe.Pointer(&ro))); err != nil {
+		return false, err
+	}
+
+	return ro != 0, nil
+}
+
+// openBlockDevice opens the block device disk with flag.
+func openBlockDevice(disk string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(disk, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		f.Close()
+		return nil, fmt.Errorf("%v is not a block device but a %v", disk, fileKindOf(fi.Mode()))
+	}
+
+	return f, nil
+}
+
+// openBlockDeviceDirect opens the block device disk with O_DIRECT, or
+// without it if the driver does not support it.
+func openBlockDeviceDirect(disk string, flag int) (*os.File, error) {
+	f, err := openBlockDevice(disk, flag|syscall.O_DIRECT)
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EINVAL {
+		return openBlockDevice(disk, flag)
+	}
+
+	return f, err
+}
+
+// IsBlockDeviceReadOnly returns true if the block device disk is set
+// read-only in the kernel, whatever the filesystem mounted on it and its
+// mount flags.
+func IsBlockDeviceReadOnly(disk string) (bool, error) {
+	f, err := openBlockDevice(disk, os.O_RDONLY)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	return blockDeviceReadOnly(f)
+}
+
+// SetBlockDeviceReadOnly sets the block device disk read-only in the
+// kernel if ro is true, and read-write otherwise.
+func SetBlockDeviceReadOnly(disk string, ro bool) error {
+	f, err := openBlockDevice(disk, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var flag int32
+	if ro {
+		flag = 1
+	}
+
+	if err := ioctlFunc(f.Fd(), unix.BLKROSET, uintptr(unsafe.Pointer(&flag))); err != nil {
+		return fmt.Errorf("Could not set %v read-only=%v: %v", disk, ro, err)
+	}
+
+	return nil
+}
+
+// blockDeviceName returns the kernel name of the block device disk,
+// e.g. "sda1" for /dev/sda1 or for a /dev/disk/by-uuid link to it.
+func blockDeviceName(disk string) (string, error) {
+	if disk == "" {
+		return "", fmt.Errorf("Disk cannot be empty")
+	}
+
+	path, err := filepath.EvalSymlinks(disk)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Base(path), nil
+}
+
+// wholeDiskName returns the kernel name of the disk holding the partition
+// name, or name itself if it is not a partition.
+func wholeDiskName(name string) (string, error) {
+	path, err := filepath.EvalSymlinks(filepath.Join(sysfsRoot, "class", "block", name))
+	if err != nil {
+		return "", fmt.Errorf("Block device %s not found in sysfs: %v", name, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "partition")); err == nil {
+		return filepath.Base(filepath.Dir(path)), nil
+	}
+
+	return name, nil
+}
+
+// sysBlockQueueAttr returns the path of the queue attribute attr of the
+// disk holding disk, since partitions do not have their own queue.
+func sysBlockQueueAttr(disk, attr string) (string, error) {
+	name, err := blockDeviceName(disk)
+	if err != nil {
+		return "", err
+	}
+
+	parent, err := wholeDiskName(name)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(sysfsRoot, "block", parent, "queue", attr), nil
+}
+
+// readSysfsString returns the content of the sysfs attribute path,
+// without the trailing newline.
+func readSysfsString(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readSysfsUint(path string) (uint64, error) {
+	s, err := readSysfsString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value %q in %s: %v", s, path, err)
+	}
+
+	return v, nil
+}
+
+// SupportsDiscard returns true if discard (TRIM) requests can be issued
+// on disk. For a partition, the disk holding it is checked.
+func SupportsDiscard(disk string) (bool, error) {
+	path, err := sysBlockQueueAttr(disk, "discard_max_bytes")
+	if err != nil {
+		return false, err
+	}
+
+	max, err := readSysfsUint(path)
+	if err != nil {
+		return false, err
+	}
+
+	return max > 0, nil
+}
+
+// IsZramDevice returns true if disk is a zram (compressed RAM) block device.
+func IsZramDevice(disk string) bool {
+	name, err := blockDeviceName(disk)
+	if err != nil || !zramDeviceRegex.MatchString(name) {
+		return false
+	}
+
+	if _, err := os.Stat(filepath.Join(sysfsRoot, "block", name)); err != nil {
+		return false
+	}
+
+	return true
+}
+
+// IsOpticalDevice returns true if disk is a CD/DVD drive, whose media
+// should be handled read-only, e.g. as iso9660. Name, SCSI device type and
+// capability flags are checked in turn. For a partition, the disk holding
+// it is checked.
+func IsOpticalDevice(disk string) (bool, error) {
+	name, err := blockDeviceName(disk)
+	if err != nil {
+		return false, err
+	}
+
+	parent, err := wholeDiskName(name)
+	if err != nil {
+		return false, err
+	}
+
+	if opticalDeviceRegex.MatchString(parent) {
+		return true, nil
+	}
+
+	sysDir := filepath.Join(sysfsRoot, "block", parent)
+
+	if t, err := readSysfsString(filepath.Join(sysDir, "device", "type")); err == nil && t == scsiTypeROM {
+		return true, nil
+	}
+
+	capability, err := readSysfsString(filepath.Join(sysDir, "capability"))
+	if err != nil {
+		return false, nil
+	}
+
+	flags, err := strconv.ParseUint(capability, 16, 64)
+	if err != nil {
+		return false, fmt.Errorf("Invalid capability %q for %s: %v", capability, disk, err)
+	}
+
+	return flags&genhdFlagCD != 0, nil
+}
+
+// parseIOScheduler parses the content of a queue/scheduler sysfs attribute,
+// e.g. "mq-deadline kyber [bfq] none", and returns the current scheduler,
+// the one between brackets, and all the available ones.
+func parseIOScheduler(s string) (string, []string, error) {
+	var current string
+	var available []string
+
+	fields := strings.Fields(s)
+	for _, f := range fields {
+		if strings.HasPrefix(f, "[") && strings.HasSuffix(f, "]") {
+			f = strings.TrimSuffix(strings.TrimPrefix(f, "["), "]")
+			current = f
+		}
+		available = append(available, f)
+	}
+
+	// Devices without an I/O scheduler only report "none".
+	if current == "" && len(available) == 1 {
+		current = available[0]
+	}
+
+	if current == "" {
+		return "", nil, fmt.Errorf("Could not find the current I/O scheduler in %q", s)
+	}
+
+	return current, available, nil
+}
+
+// GetIOScheduler returns the I/O scheduler currently used by disk. For a
+// partition, the scheduler of the disk holding it is returned.
+func GetIOScheduler(disk string) (string, error) {
+	path, err := sysBlockQueueAttr(disk, "scheduler")
+	if err != nil {
+		return "", err
+	}
+
+	s, err := readSysfsString(path)
+	if err != nil {
+		return "", err
+	}
+
+	current, _, err := parseIOScheduler(s)
+	return current, err
+}
+
+// SetIOScheduler makes disk use the scheduler I/O scheduler, which must be
+// one of the schedulers available for disk. For a partition, the scheduler
+// of the disk holding it is changed.
+func SetIOScheduler(disk, scheduler string) error {
+	if scheduler == "" {
+		return fmt.Errorf("I/O scheduler cannot be empty")
+	}
+
+	path, err := sysBlockQueueAttr(disk, "scheduler")
+	if err != nil {
+		return err
+	}
+
+	s, err := readSysfsString(path)
+	if err != nil {
+		return err
+	}
+
+	_, available, err := parseIOScheduler(s)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range available {
+		if a == scheduler {
+			return WriteToFile(path, []byte(scheduler))
+		}
+	}
+
+	return fmt.Errorf("I/O scheduler %s not available for %s, available schedulers: %s", scheduler, disk, strings.Join(available, " "))
+}
+
+// write_cache values, see Documentation/block/queue-sysfs.txt
+const (
+	writeCacheWriteBack    = "write back"
+	writeCacheWriteThrough = "write through"
+)
+
+// GetWriteCache returns true if disk has a volatile write cache, which
+// data must be flushed from to reach stable storage. For a partition, the
+// write cache of the disk holding it is reported.
+func GetWriteCache(disk string) (bool, error) {
+	path, err := sysBlockQueueAttr(disk, "write_cache")
+	if err != nil {
+		return false, err
+	}
+
+	s, err := readSysfsString(path)
+	if err != nil {
+		return false, err
+	}
+
+	switch s {
+	case writeCacheWriteBack:
+		return true, nil
+	case writeCacheWriteThrough:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Unexpected write cache mode %q for %s", s, disk)
+}
+
+// SetWriteCache makes the kernel treat the write cache of disk as enabled
+// or not. This does not change the device itself: telling the kernel the
+// cache is disabled while the device still caches writes stops the flushes
+// crash consistency relies on. For a partition, the disk holding it is
+// changed.
+func SetWriteCache(disk string, enabled bool) error {
+	path, err := sysBlockQueueAttr(disk, "write_cache")
+	if err != nil {
+		return err
+	}
+
+	mode := writeCacheWriteThrough
+	if enabled {
+		mode = writeCacheWriteBack
+	}
+
+	return WriteToFile(path, []byte(mode))
+}
+
+// GetQueueDepth returns how many requests the block layer queues for disk,
+// see queue/nr_requests. For a partition, the queue of the disk holding it
+// is reported.
+func GetQueueDepth(disk string) (int, error) {
+	path, err := sysBlockQueueAttr(disk, "nr_requests")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := readSysfsUint(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// SetQueueDepth sets how many requests the block layer queues for disk to
+// n, which must be positive. For a partition, the disk holding it is
+// changed.
+func SetQueueDepth(disk string, n int) error {
+	if n <= 0 {
+		return fmt.Errorf("Invalid queue depth %d, it must be positive", n)
+	}
+
+	path, err := sysBlockQueueAttr(disk, "nr_requests")
+	if err != nil {
+		return err
+	}
+
+	return WriteToFile(path, []byte(strconv.Itoa(n)))
+}
+
+// deviceTimeoutAttr returns the path of the device/timeout attribute of
+// the disk holding disk, or an error if its driver has none, e.g. loop or
+// device mapper devices, or NVMe namespaces whose timeout is a module
+// parameter.
+func deviceTimeoutAttr(disk string) (string, error) {
+	name, err := blockDeviceName(disk)
+	if err != nil {
+		return "", err
+	}
+
+	parent, err := wholeDiskName(name)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(sysfsRoot, "block", parent, "device", "timeout")
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%s has no I/O timeout to tune: %v", disk, err)
+	}
+
+	return path, nil
+}
+
+// GetDeviceTimeout returns the timeout in seconds of the I/O requests sent
+// to disk, e.g. a SCSI disk, after which the kernel starts error recovery.
+// For a partition, the timeout of the disk holding it is reported.
+func GetDeviceTimeout(disk string) (int, error) {
+	path, err := deviceTimeoutAttr(disk)
+	if err != nil {
+		return 0, err
+	}
+
+	seconds, err := readSysfsUint(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(seconds), nil
+}
+
+// SetDeviceTimeout sets the timeout of the I/O requests sent to disk to
+// seconds, which must be positive, e.g. to bound the stalls on a failing
+// disk. For a partition, the disk holding it is changed.
+func SetDeviceTimeout(disk string, seconds int) error {
+	if seconds <= 0 {
+		return fmt.Errorf("Invalid device timeout %d, it must be positive", seconds)
+	}
+
+	path, err := deviceTimeoutAttr(disk)
+	if err != nil {
+		return err
+	}
+
+	return WriteToFile(path, []byte(strconv.Itoa(seconds)))
+}
+
+// OptimalIOSize returns the minimum and the optimal I/O sizes in bytes of
+// the disk holding disk, as reported by the block layer, e.g. the chunk
+// size and the stripe width of a RAID array. An optimal size of 0 means the
+// device does not report one, in which case the minimum size should be
+// used as the granularity of the requests.
+func OptimalIOSize(disk string) (int, int, error) {
+	var sizes [2]int
+
+	for i, attr := range []string{"minimum_io_size", "optimal_io_size"} {
+		path, err := sysBlockQueueAttr(disk, attr)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		v, err := readSysfsUint(path)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		sizes[i] = int(v)
+	}
+
+	return sizes[0], sizes[1], nil
+}
+
+// MaxSectorsKB returns the size in KiB of the largest request the block
+// layer issues to the disk holding disk, larger requests are split.
+func MaxSectorsKB(disk string) (int, error) {
+	path, err := sysBlockQueueAttr(disk, "max_sectors_kb")
+	if err != nil {
+		return 0, err
+	}
+
+	kb, err := readSysfsUint(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(kb), nil
+}
+
+// capRequestSize returns size capped to MaxSectorsKB when f, named disk,
+// is a block device, so that the chunked I/O helpers do not issue requests
+// the kernel would split. size is returned as is if the limit is unknown.
+func capRequestSize(f *os.File, disk string, size int64) int64 {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeDevice == 0 {
+		return size
+	}
+
+	kb, err := MaxSectorsKB(disk)
+	if err != nil || kb <= 0 {
+		return size
+	}
+
+	if max := int64(kb) << 10; max < size {
+		return max
+	}
+
+	return size
+}
+
+// AlignmentOffset returns how many bytes the start of disk, a whole disk
+// or a partition, is offset from the natural alignment of its physical
+// blocks. Anything but 0 means I/O requests are misaligned and slower,
+// e.g. on 4Kn drives or on some SSDs. The kernel reports -1 when the
+// device cannot be aligned at all.
+func AlignmentOffset(disk string) (int, error) {
+	name, err := blockDeviceName(disk)
+	if err != nil {
+		return 0, err
+	}
+
+	// Partitions have their own alignment_offset, relative to the
+	// alignment of their disk.
+	path := filepath.Join(sysfsRoot, "class", "block", name, "alignment_offset")
+	s, err := readSysfsString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value %q in %s: %v", s, path, err)
+	}
+
+	return offset, nil
+}
+
+// blockDeviceLinks returns the paths of the block devices listed in the
+// holders or slaves sysfs directory of disk.
+func blockDeviceLinks(disk, dir string) ([]string, error) {
+	name, err := blockDeviceName(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	sysDir := filepath.Join(sysfsRoot, "class", "block", name)
+	if _, err := os.Stat(sysDir); err != nil {
+		return nil, fmt.Errorf("Block device %s not found in sysfs: %v", name, err)
+	}
+
+	// Partitions have no slaves directory.
+	links, err := ioutil.ReadDir(filepath.Join(sysDir, dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var devices []string
+	for _, l := range links {
+		devices = append(devices, filepath.Join(devRoot, l.Name()))
+	}
+
+	return devices, nil
+}
+
+// BlockDeviceHolders returns the paths of the block devices built on top
+// of disk, e.g. the device mapper devices using it.
+func BlockDeviceHolders(disk string) ([]string, error) {
+	return blockDeviceLinks(disk, "holders")
+}
+
+// BlockDeviceSlaves returns the paths of the block devices disk is built
+// on, e.g. the devices underlying a device mapper device.
+func BlockDeviceSlaves(disk string) ([]string, error) {
+	return blockDeviceLinks(disk, "slaves")
+}
+
+// DMUnderlyingDevices returns the paths of the block devices a device
+// mapper device, e.g. /dev/mapper/foo or /dev/dm-0, is built on.
+func DMUnderlyingDevices(dmPath string) ([]string, error) {
+	name, err := blockDeviceName(dmPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(name, "dm-") {
+		return nil, fmt.Errorf("%s is not a device mapper device", dmPath)
+	}
+
+	return BlockDeviceSlaves(dmPath)
+}
+
+// PartitionInfo describes a partition of a disk, as seen by the kernel.
+type PartitionInfo struct {
+	// Name is the kernel name of the partition, e.g. "nvme0n1p1".
+	Name string
+
+	// Path is the path of the device file of the partition.
+	Path string
+
+	// Number is the partition number on the disk.
+	Number int
+
+	// Start is the offset in bytes of the partition on the disk.
+	Start uint64
+
+	// Size is the size in bytes of the partition.
+	Size uint64
+}
+
+// DiskPartitions returns the partitions of the whole disk disk, ordered by
+// partition number, from the partition table as parsed by the kernel.
+// Partitions are looked up in sysfs rather than guessed from the name of
+// disk, since their names depend on the driver, e.g. "sda1" but
+// "nvme0n1p1" or "mmcblk0p1".
+func DiskPartitions(disk string) ([]PartitionInfo, error) {
+	name, err := blockDeviceName(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, err := wholeDiskName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent != name {
+		return nil, fmt.Errorf("%s is a partition of %s, not a whole disk", disk, parent)
+	}
+
+	sysDir := filepath.Join(sysfsRoot, "block", name)
+	entries, err := ioutil.ReadDir(sysDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var partitions []PartitionInfo
+	for _, e := range entries {
+		dir := filepath.Join(sysDir, e.Name())
+
+		number, err := readSysfsUint(filepath.Join(dir, "partition"))
+		if os.IsNotExist(err) {
+			// Not a partition, e.g. the queue directory.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		start, err := readSysfsUint(filepath.Join(dir, "start"))
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := readSysfsUint(filepath.Join(dir, "size"))
+		if err != nil {
+			return nil, err
+		}
+
+		partitions = append(partitions, PartitionInfo{
+			Name:   e.Name(),
+			Path:   filepath.Join(devRoot, e.Name()),
+			Number: int(number),
+			Start:  start * sectorSize,
+			Size:   size * sectorSize,
+		})
+	}
+
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].Number < partitions[j].Number
+	})
+
+	return partitions, nil
+}
+
+// CanWriteDevice checks that disk can be opened for writing, without
+// writing anything. It returns false and no error when write access is
+// denied, either by permissions or because disk is read-only, and an error
+// when disk could not be checked, e.g. because it is busy.
+func CanWriteDevice(disk string) (bool, error) {
+	f, err := os.OpenFile(disk, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err == nil {
+		defer f.Close()
+
+		// Opening a read-only block device for writing does not
+		// fail, writing to it does.
+		ro, err := blockDeviceReadOnly(f)
+		if err != nil {
+			return false, err
+		}
+
+		return !ro, nil
+	}
+
+	perr, ok := err.(*os.PathError)
+	if !ok {
+		return false, err
+	}
+
+	switch perr.Err {
+	case syscall.EACCES, syscall.EPERM, syscall.EROFS:
+		return false, nil
+	case syscall.EBUSY:
+		return false, fmt.Errorf("Device %s is busy: %v", disk, err)
+	}
+
+	return false, err
+}
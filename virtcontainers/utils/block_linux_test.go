@@ -0,0 +1,797 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	ktu "github.com/kata-containers/runtime/pkg/katatestutils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+const testDisabledAsNonRoot = "Test disabled as requires root privileges"
+
+var tc ktu.TestConstraint
+
+func init() {
+	tc = ktu.NewTestConstraint(false)
+}
+
+// setupLoopDevice attaches a size bytes loop device to a new file and
+// returns the loop device path and a function to detach it. args are
+// extra losetup arguments. The test is skipped if loop devices are not
+// available.
+func setupLoopDevice(t *testing.T, size int64, args ...string) (string, func()) {
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	if _, err := exec.LookPath("losetup"); err != nil {
+		t.Skip("losetup not available")
+	}
+
+	f, err := ioutil.TempFile("", "loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backingFile := f.Name()
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		os.Remove(backingFile)
+		t.Fatal(err)
+	}
+	f.Close()
+
+	args = append(args, "--find", "--show", backingFile)
+	out, err := exec.Command("losetup", args...).CombinedOutput()
+	if err != nil {
+		os.Remove(backingFile)
+		t.Skipf("Could not setup loop device: %v: %s", err, out)
+	}
+	loop := strings.TrimSpace(string(out))
+
+	return loop, func() {
+		exec.Command("losetup", "--detach", loop).Run()
+		os.Remove(backingFile)
+	}
+}
+
+// testSysfs is a fake sysfs tree, along with a fake /dev directory
+// holding the device files of the block devices added to it.
+type testSysfs struct {
+	t    *testing.T
+	root string
+	dev  string
+}
+
+// newTestSysfs creates an empty fake sysfs tree and makes sysfsRoot point
+// to it until the returned function is called.
+func newTestSysfs(t *testing.T) (*testSysfs, func()) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orgSysfsRoot := sysfsRoot
+	sysfsRoot = filepath.Join(dir, "sys")
+
+	s := &testSysfs{
+		t:    t,
+		root: sysfsRoot,
+		dev:  filepath.Join(dir, "dev"),
+	}
+
+	for _, d := range []string{filepath.Join(s.root, "block"), filepath.Join(s.root, "class", "block"), s.dev} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return s, func() {
+		sysfsRoot = orgSysfsRoot
+		os.RemoveAll(dir)
+	}
+}
+
+// writeAttrs writes the attributes, relative to dir, in the fake sysfs.
+func (s *testSysfs) writeAttrs(dir string, attrs map[string]string) {
+	for attr, value := range attrs {
+		path := filepath.Join(dir, attr)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			s.t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+}
+
+// addDevice adds the device name, whose sysfs directory is sysDir, and
+// returns the path of its device file.
+func (s *testSysfs) addDevice(name, sysDir string, attrs map[string]string) string {
+	if err := os.MkdirAll(sysDir, 0755); err != nil {
+		s.t.Fatal(err)
+	}
+	s.writeAttrs(sysDir, attrs)
+
+	if err := os.Symlink(sysDir, filepath.Join(s.root, "class", "block", name)); err != nil {
+		s.t.Fatal(err)
+	}
+
+	devPath := filepath.Join(s.dev, name)
+	if err := ioutil.WriteFile(devPath, nil, 0644); err != nil {
+		s.t.Fatal(err)
+	}
+
+	return devPath
+}
+
+// addDisk adds the whole disk name and returns the path of its device file.
+func (s *testSysfs) addDisk(name string, attrs map[string]string) string {
+	return s.addDevice(name, filepath.Join(s.root, "block", name), attrs)
+}
+
+// addPartition adds the partition name of disk and returns the path of
+// its device file.
+func (s *testSysfs) addPartition(disk, name string, attrs map[string]string) string {
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	if _, ok := attrs["partition"]; !ok {
+		attrs["partition"] = "1"
+	}
+
+	return s.addDevice(name, filepath.Join(s.root, "block", disk, name), attrs)
+}
+
+func TestGetBlockDeviceSize(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := GetBlockDeviceSize("/does/not/exist")
+	assert.Error(err)
+
+	// Not a block device
+	_, err = GetBlockDeviceSize("/dev/null")
+	assert.Error(err)
+
+	loop, cleanup := setupLoopDevice(t, 8<<20)
+	defer cleanup()
+
+	size, err := GetBlockDeviceSize(loop)
+	assert.NoError(err)
+	assert.Equal(uint64(8<<20), size)
+}
+
+func TestGetBlockDeviceSizeFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	loop, cleanup := setupLoopDevice(t, 8<<20)
+	defer cleanup()
+
+	var requests []uintptr
+	orgIoctlFunc := ioctlFunc
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+	}()
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		requests = append(requests, request)
+		if request == unix.BLKGETSIZE64 {
+			return os.NewSyscallError("ioctl", syscall.ENOTTY)
+		}
+		return Ioctl(fd, request, arg1)
+	}
+
+	size, err := GetBlockDeviceSize(loop)
+	assert.NoError(err)
+	assert.Equal(uint64(8<<20), size)
+	assert.Equal([]uintptr{unix.BLKGETSIZE64, unix.BLKGETSIZE}, requests)
+
+	// Other errors are not retried.
+	requests = nil
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		requests = append(requests, request)
+		return os.NewSyscallError("ioctl", syscall.EIO)
+	}
+
+	_, err = GetBlockDeviceSize(loop)
+	assert.Error(err)
+	assert.Equal([]uintptr{unix.BLKGETSIZE64}, requests)
+}
+
+func TestSupportsDiscard(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	sda := sysfs.addDisk("sda", map[string]string{"queue/discard_max_bytes": "2147450880"})
+	sda1 := sysfs.addPartition("sda", "sda1", nil)
+	sdb := sysfs.addDisk("sdb", map[string]string{"queue/discard_max_bytes": "0"})
+	sdc := sysfs.addDisk("sdc", nil)
+
+	for _, disk := range []string{sda, sda1} {
+		ok, err := SupportsDiscard(disk)
+		assert.NoError(err, disk)
+		assert.True(ok, disk)
+	}
+
+	ok, err := SupportsDiscard(sdb)
+	assert.NoError(err)
+	assert.False(ok)
+
+	_, err = SupportsDiscard(sdc)
+	assert.Error(err)
+
+	_, err = SupportsDiscard(filepath.Join(sysfs.dev, "sdz"))
+	assert.Error(err)
+
+	_, err = SupportsDiscard("")
+	assert.Error(err)
+}
+
+func TestIsZramDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	zram0 := sysfs.addDisk("zram0", map[string]string{"disksize": "1073741824"})
+	zram1 := sysfs.addDisk("zram1", map[string]string{"disksize": "0"})
+	zram12 := sysfs.addDisk("zram12", nil)
+	sda := sysfs.addDisk("sda", nil)
+	zramfoo := sysfs.addDisk("zramfoo", nil)
+
+	// Device file with no sysfs entry.
+	zram2 := filepath.Join(sysfs.dev, "zram2")
+	err := ioutil.WriteFile(zram2, nil, 0644)
+	assert.NoError(err)
+
+	tests := []struct {
+		disk     string
+		expected bool
+	}{
+		{zram0, true},
+		{zram1, true},
+		{zram12, true},
+		{zram2, false},
+		{sda, false},
+		{zramfoo, false},
+		{filepath.Join(sysfs.dev, "zram3"), false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.expected, IsZramDevice(test.disk), test.disk)
+	}
+}
+
+func TestIsOpticalDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	sr0 := sysfs.addDisk("sr0", nil)
+	scd1 := sysfs.addDisk("scd1", nil)
+	sda := sysfs.addDisk("sda", map[string]string{"device/type": "0", "capability": "50"})
+	sda1 := sysfs.addPartition("sda", "sda1", nil)
+	sdb := sysfs.addDisk("sdb", map[string]string{"device/type": "5"})
+	sdb1 := sysfs.addPartition("sdb", "sdb1", nil)
+	sdc := sysfs.addDisk("sdc", map[string]string{"capability": "19"})
+	vda := sysfs.addDisk("vda", nil)
+	srfoo := sysfs.addDisk("srfoo", nil)
+	sdd := sysfs.addDisk("sdd", map[string]string{"capability": "bogus"})
+
+	tests := []struct {
+		disk     string
+		expected bool
+	}{
+		{sr0, true},
+		{scd1, true},
+		{sda, false},
+		{sda1, false},
+		{sdb, true},
+		{sdb1, true},
+		{sdc, true},
+		{vda, false},
+		{srfoo, false},
+	}
+
+	for _, test := range tests {
+		optical, err := IsOpticalDevice(test.disk)
+		assert.NoError(err, test.disk)
+		assert.Equal(test.expected, optical, test.disk)
+	}
+
+	_, err := IsOpticalDevice(sdd)
+	assert.Error(err)
+
+	_, err = IsOpticalDevice(filepath.Join(sysfs.dev, "sr1"))
+	assert.Error(err)
+}
+
+func TestParseIOScheduler(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		s         string
+		current   string
+		available []string
+		err       bool
+	}{
+		{"mq-deadline kyber [bfq] none", "bfq", []string{"mq-deadline", "kyber", "bfq", "none"}, false},
+		{"[none] mq-deadline", "none", []string{"none", "mq-deadline"}, false},
+		{"noop deadline [cfq]", "cfq", []string{"noop", "deadline", "cfq"}, false},
+		{"none", "none", []string{"none"}, false},
+		{"mq-deadline none", "", nil, true},
+		{"", "", nil, true},
+	}
+
+	for _, test := range tests {
+		current, available, err := parseIOScheduler(test.s)
+		if test.err {
+			assert.Error(err, test.s)
+			continue
+		}
+		assert.NoError(err, test.s)
+		assert.Equal(test.current, current, test.s)
+		assert.Equal(test.available, available, test.s)
+	}
+}
+
+func TestIOScheduler(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	vda := sysfs.addDisk("vda", map[string]string{"queue/scheduler": "[mq-deadline] kyber none"})
+	vda1 := sysfs.addPartition("vda", "vda1", nil)
+	vdb := sysfs.addDisk("vdb", nil)
+
+	scheduler, err := GetIOScheduler(vda1)
+	assert.NoError(err)
+	assert.Equal("mq-deadline", scheduler)
+
+	err = SetIOScheduler(vda1, "none")
+	assert.NoError(err)
+
+	// sysfs would switch the current scheduler, the fake one only
+	// records what was written, over its previous content.
+	data, err := ioutil.ReadFile(filepath.Join(sysfs.root, "block", "vda", "queue", "scheduler"))
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(string(data), "none"))
+
+	assert.Error(SetIOScheduler(vda, "bfq"))
+	assert.Error(SetIOScheduler(vda, ""))
+
+	_, err = GetIOScheduler(vdb)
+	assert.Error(err)
+	assert.Error(SetIOScheduler(vdb, "none"))
+}
+
+func TestWriteCache(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	vda := sysfs.addDisk("vda", map[string]string{"queue/write_cache": "write back"})
+	vda1 := sysfs.addPartition("vda", "vda1", nil)
+	vdb := sysfs.addDisk("vdb", map[string]string{"queue/write_cache": "write through"})
+	vdc := sysfs.addDisk("vdc", map[string]string{"queue/write_cache": "bogus"})
+	vdd := sysfs.addDisk("vdd", nil)
+
+	enabled, err := GetWriteCache(vda1)
+	assert.NoError(err)
+	assert.True(enabled)
+
+	enabled, err = GetWriteCache(vdb)
+	assert.NoError(err)
+	assert.False(enabled)
+
+	_, err = GetWriteCache(vdc)
+	assert.Error(err)
+
+	_, err = GetWriteCache(vdd)
+	assert.Error(err)
+
+	assert.NoError(SetWriteCache(vda1, false))
+	data, err := ioutil.ReadFile(filepath.Join(sysfs.root, "block", "vda", "queue", "write_cache"))
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(string(data), "write through"))
+
+	assert.NoError(SetWriteCache(vdb, true))
+	data, err = ioutil.ReadFile(filepath.Join(sysfs.root, "block", "vdb", "queue", "write_cache"))
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(string(data), "write back"))
+
+	assert.Error(SetWriteCache(vdd, true))
+	assert.Error(SetWriteCache(vda+"-does-not-exist", true))
+}
+
+func TestQueueDepth(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	sysfs.addDisk("vda", map[string]string{"queue/nr_requests": "64"})
+	vda1 := sysfs.addPartition("vda", "vda1", nil)
+	vdb := sysfs.addDisk("vdb", map[string]string{"queue/nr_requests": "bogus"})
+	vdc := sysfs.addDisk("vdc", nil)
+
+	depth, err := GetQueueDepth(vda1)
+	assert.NoError(err)
+	assert.Equal(64, depth)
+
+	_, err = GetQueueDepth(vdb)
+	assert.Error(err)
+
+	_, err = GetQueueDepth(vdc)
+	assert.Error(err)
+
+	assert.NoError(SetQueueDepth(vda1, 256))
+	data, err := ioutil.ReadFile(filepath.Join(sysfs.root, "block", "vda", "queue", "nr_requests"))
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(string(data), "256"))
+
+	assert.Error(SetQueueDepth(vda1, 0))
+	assert.Error(SetQueueDepth(vda1, -1))
+	assert.Error(SetQueueDepth(vdc, 32))
+}
+
+func TestDeviceTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	sysfs.addDisk("sda", map[string]string{"device/timeout": "30"})
+	sda1 := sysfs.addPartition("sda", "sda1", nil)
+	sdb := sysfs.addDisk("sdb", map[string]string{"device/timeout": "bogus"})
+	loop0 := sysfs.addDisk("loop0", map[string]string{"queue/nr_requests": "128"})
+
+	timeout, err := GetDeviceTimeout(sda1)
+	assert.NoError(err)
+	assert.Equal(30, timeout)
+
+	_, err = GetDeviceTimeout(sdb)
+	assert.Error(err)
+
+	_, err = GetDeviceTimeout(loop0)
+	assert.Error(err)
+	assert.Contains(err.Error(), "no I/O timeout")
+
+	assert.NoError(SetDeviceTimeout(sda1, 180))
+	data, err := ioutil.ReadFile(filepath.Join(sysfs.root, "block", "sda", "device", "timeout"))
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(string(data), "180"))
+
+	assert.Error(SetDeviceTimeout(sda1, 0))
+	assert.Error(SetDeviceTimeout(sda1, -1))
+	assert.Error(SetDeviceTimeout(loop0, 30))
+	assert.Error(SetDeviceTimeout(sda1+"-does-not-exist", 30))
+}
+
+func TestOptimalIOSize(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	sysfs.addDisk("md0", map[string]string{
+		"queue/minimum_io_size": "524288",
+		"queue/optimal_io_size": "1048576",
+	})
+	md0p1 := sysfs.addPartition("md0", "md0p1", nil)
+	sda := sysfs.addDisk("sda", map[string]string{
+		"queue/minimum_io_size": "4096",
+		"queue/optimal_io_size": "0",
+	})
+	sdb := sysfs.addDisk("sdb", map[string]string{"queue/minimum_io_size": "512"})
+
+	min, optimal, err := OptimalIOSize(md0p1)
+	assert.NoError(err)
+	assert.Equal(524288, min)
+	assert.Equal(1048576, optimal)
+
+	min, optimal, err = OptimalIOSize(sda)
+	assert.NoError(err)
+	assert.Equal(4096, min)
+	assert.Equal(0, optimal)
+
+	_, _, err = OptimalIOSize(sdb)
+	assert.Error(err)
+
+	_, _, err = OptimalIOSize(sda + "-does-not-exist")
+	assert.Error(err)
+}
+
+func TestMaxSectorsKB(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	sysfs.addDisk("sda", map[string]string{"queue/max_sectors_kb": "1280"})
+	sda1 := sysfs.addPartition("sda", "sda1", nil)
+	sdb := sysfs.addDisk("sdb", map[string]string{"queue/max_sectors_kb": "bogus"})
+	sdc := sysfs.addDisk("sdc", nil)
+
+	kb, err := MaxSectorsKB(sda1)
+	assert.NoError(err)
+	assert.Equal(1280, kb)
+
+	_, err = MaxSectorsKB(sdb)
+	assert.Error(err)
+	_, err = MaxSectorsKB(sdc)
+	assert.Error(err)
+
+	// The fake device files are regular files, never capped.
+	f, err := os.Open(sda1)
+	assert.NoError(err)
+	defer f.Close()
+	assert.Equal(int64(1<<20), capRequestSize(f, sda1, 1<<20))
+}
+
+func TestAlignmentOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	sda := sysfs.addDisk("sda", map[string]string{"alignment_offset": "0"})
+	sda1 := sysfs.addPartition("sda", "sda1", map[string]string{"alignment_offset": "3584"})
+	sdb := sysfs.addDisk("sdb", map[string]string{"alignment_offset": "-1"})
+	sdc := sysfs.addDisk("sdc", map[string]string{"alignment_offset": "bogus"})
+	sdd := sysfs.addDisk("sdd", nil)
+
+	for disk, expected := range map[string]int{sda: 0, sda1: 3584, sdb: -1} {
+		offset, err := AlignmentOffset(disk)
+		assert.NoError(err, disk)
+		assert.Equal(expected, offset, disk)
+	}
+
+	for _, disk := range []string{sdc, sdd, sda + "-does-not-exist", ""} {
+		_, err := AlignmentOffset(disk)
+		assert.Error(err, disk)
+	}
+}
+
+func TestDMUnderlyingDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	orgDevRoot := devRoot
+	defer func() {
+		devRoot = orgDevRoot
+	}()
+	devRoot = sysfs.dev
+
+	sysfs.addDisk("sda", nil)
+	sysfs.addDisk("sdb", nil)
+	sysfs.addPartition("sdb", "sdb1", nil)
+	dm0 := sysfs.addDisk("dm-0", nil)
+	dm1 := sysfs.addDisk("dm-1", nil)
+	sda := filepath.Join(sysfs.dev, "sda")
+
+	for _, slave := range []string{"sda", "sdb1"} {
+		err := os.MkdirAll(filepath.Join(sysfs.root, "block", "dm-0", "slaves"), 0755)
+		assert.NoError(err)
+		err = os.Symlink(filepath.Join(sysfs.root, "class", "block", slave), filepath.Join(sysfs.root, "block", "dm-0", "slaves", slave))
+		assert.NoError(err)
+	}
+
+	err := os.MkdirAll(filepath.Join(sysfs.dev, "mapper"), 0755)
+	assert.NoError(err)
+	mapper := filepath.Join(sysfs.dev, "mapper", "foo")
+	err = os.Symlink("../dm-0", mapper)
+	assert.NoError(err)
+
+	for _, disk := range []string{mapper, dm0} {
+		devices, err := DMUnderlyingDevices(disk)
+		assert.NoError(err, disk)
+		assert.Equal([]string{sda, filepath.Join(sysfs.dev, "sdb1")}, devices, disk)
+	}
+
+	// No slaves directory
+	devices, err := DMUnderlyingDevices(dm1)
+	assert.NoError(err)
+	assert.Empty(devices)
+
+	_, err = DMUnderlyingDevices(sda)
+	assert.Error(err)
+
+	_, err = DMUnderlyingDevices(filepath.Join(sysfs.dev, "mapper", "bar"))
+	assert.Error(err)
+}
+
+func TestBlockDeviceHoldersSlaves(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	orgDevRoot := devRoot
+	defer func() {
+		devRoot = orgDevRoot
+	}()
+	devRoot = sysfs.dev
+
+	link := func(from, dir, to string) {
+		path := filepath.Join(sysfs.root, "class", "block", from, dir)
+		err := os.MkdirAll(path, 0755)
+		assert.NoError(err)
+		err = os.Symlink(filepath.Join(sysfs.root, "class", "block", to), filepath.Join(path, to))
+		assert.NoError(err)
+	}
+
+	sda := sysfs.addDisk("sda", nil)
+	sda1 := sysfs.addPartition("sda", "sda1", nil)
+	sdb := sysfs.addDisk("sdb", nil)
+	dm0 := sysfs.addDisk("dm-0", nil)
+
+	link("sda1", "holders", "dm-0")
+	link("sdb", "holders", "dm-0")
+	link("dm-0", "slaves", "sda1")
+	link("dm-0", "slaves", "sdb")
+
+	tests := []struct {
+		disk    string
+		holders []string
+		slaves  []string
+	}{
+		{sda, nil, nil},
+		{sda1, []string{dm0}, nil},
+		{sdb, []string{dm0}, nil},
+		{dm0, nil, []string{sda1, sdb}},
+	}
+
+	for _, test := range tests {
+		holders, err := BlockDeviceHolders(test.disk)
+		assert.NoError(err, test.disk)
+		assert.Equal(test.holders, holders, test.disk)
+
+		slaves, err := BlockDeviceSlaves(test.disk)
+		assert.NoError(err, test.disk)
+		assert.Equal(test.slaves, slaves, test.disk)
+	}
+
+	// Device file with no sysfs entry
+	sdc := filepath.Join(sysfs.dev, "sdc")
+	err := ioutil.WriteFile(sdc, nil, 0644)
+	assert.NoError(err)
+
+	_, err = BlockDeviceHolders(sdc)
+	assert.Error(err)
+	_, err = BlockDeviceSlaves(sdc)
+	assert.Error(err)
+}
+
+func TestCanWriteDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	ok, err := CanWriteDevice("/dev/null")
+	assert.NoError(err)
+	assert.True(ok)
+
+	_, err = CanWriteDevice("/does/not/exist")
+	assert.Error(err)
+
+	loop, cleanup := setupLoopDevice(t, 1<<20)
+	defer cleanup()
+
+	ok, err = CanWriteDevice(loop)
+	assert.NoError(err)
+	assert.True(ok)
+
+	roLoop, roCleanup := setupLoopDevice(t, 1<<20, "--read-only")
+	defer roCleanup()
+
+	ok, err = CanWriteDevice(roLoop)
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+func TestBlockDeviceReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := IsBlockDeviceReadOnly("/dev/null")
+	assert.Error(err)
+
+	err = SetBlockDeviceReadOnly("/dev/null", true)
+	assert.Error(err)
+
+	_, err = IsBlockDeviceReadOnly("/does/not/exist")
+	assert.Error(err)
+
+	loop, cleanup := setupLoopDevice(t, 1<<20)
+	defer cleanup()
+
+	ro, err := IsBlockDeviceReadOnly(loop)
+	assert.NoError(err)
+	assert.False(ro)
+
+	assert.NoError(SetBlockDeviceReadOnly(loop, true))
+	ro, err = IsBlockDeviceReadOnly(loop)
+	assert.NoError(err)
+	assert.True(ro)
+
+	ok, err := CanWriteDevice(loop)
+	assert.NoError(err)
+	assert.False(ok)
+
+	assert.NoError(SetBlockDeviceReadOnly(loop, false))
+	ro, err = IsBlockDeviceReadOnly(loop)
+	assert.NoError(err)
+	assert.False(ro)
+
+	roLoop, roCleanup := setupLoopDevice(t, 1<<20, "--read-only")
+	defer roCleanup()
+
+	ro, err = IsBlockDeviceReadOnly(roLoop)
+	assert.NoError(err)
+	assert.True(ro)
+}
+
+func TestDiskPartitions(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	orgDevRoot := devRoot
+	defer func() {
+		devRoot = orgDevRoot
+	}()
+	devRoot = sysfs.dev
+
+	nvme := sysfs.addDisk("nvme0n1", map[string]string{"queue/nr_requests": "64"})
+	sysfs.addPartition("nvme0n1", "nvme0n1p10", map[string]string{"partition": "10", "start": "4096", "size": "2048"})
+	nvme1 := sysfs.addPartition("nvme0n1", "nvme0n1p1", map[string]string{"partition": "1", "start": "2048", "size": "1024"})
+	sysfs.addPartition("nvme0n1", "nvme0n1p2", map[string]string{"partition": "2", "start": "3072", "size": "1024"})
+
+	partitions, err := DiskPartitions(nvme)
+	assert.NoError(err)
+	assert.Equal([]PartitionInfo{
+		{Name: "nvme0n1p1", Path: filepath.Join(sysfs.dev, "nvme0n1p1"), Number: 1, Start: 2048 * 512, Size: 1024 * 512},
+		{Name: "nvme0n1p2", Path: filepath.Join(sysfs.dev, "nvme0n1p2"), Number: 2, Start: 3072 * 512, Size: 1024 * 512},
+		{Name: "nvme0n1p10", Path: filepath.Join(sysfs.dev, "nvme0n1p10"), Number: 10, Start: 4096 * 512, Size: 2048 * 512},
+	}, partitions)
+
+	// Not a whole disk
+	_, err = DiskPartitions(nvme1)
+	assert.Error(err)
+
+	// No partition table
+	vda := sysfs.addDisk("vda", nil)
+	partitions, err = DiskPartitions(vda)
+	assert.NoError(err)
+	assert.Empty(partitions)
+
+	// Bogus size
+	mmc := sysfs.addDisk("mmcblk0", nil)
+	sysfs.addPartition("mmcblk0", "mmcblk0p1", map[string]string{"start": "2048", "size": "bogus"})
+	_, err = DiskPartitions(mmc)
+	assert.Error(err)
+
+	_, err = DiskPartitions(vda + "-does-not-exist")
+	assert.Error(err)
+	_, err = DiskPartitions("")
+	assert.Error(err)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ContextIDAllocator allocates vsock context IDs to sandboxes.
+type ContextIDAllocator interface {
+	// Allocate allocates a context ID. The returned file, when not nil,
+	// holds the context ID and must be handed to the VMM.
+	Allocate() (*os.File, uint64, error)
+
+	// Release releases a context ID returned by Allocate.
+	Release(cid uint64) error
+}
+
+// ContextIDInfo describes an allocated context ID.
+type ContextIDInfo struct {
+	// ContextID is the context ID.
+	ContextID uint64
+
+	// Name is the name the context ID was allocated for, if any.
+	Name string
+
+	// Allocated is when the context ID was allocated.
+	Allocated time.Time
+}
+
+// allocatedContextID is a context ID allocated by a VhostContextIDAllocator.
+type allocatedContextID struct {
+	file *os.File
+	info ContextIDInfo
+}
+
+// sortContextIDInfos sorts infos by context ID.
+func sortContextIDInfos(infos []ContextIDInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ContextID < infos[j].ContextID
+	})
+}
+
+// VhostContextIDAllocator is the default ContextIDAllocator, it allocates
+// context IDs through the vhost-vsock device, see FindContextIDWithOptions.
+// It keeps the vhost file holding every context ID it allocated until the
+// context ID is released, callers must not close it themselves.
+type VhostContextIDAllocator struct {
+	// Options are the options of the context ID scans.
+	Options ContextIDOptions
+
+	// mu protects allocated, it is not held while scanning so that
+	// allocations do not wait for each other, the kernel never hands out a
+	// context ID twice.
+	mu        sync.Mutex
+	allocated map[uint64]allocatedContextID
+}
+
+// NewVhostContextIDAllocator returns a VhostContextIDAllocator scanning
+// with the default options.
+func NewVhostContextIDAllocator() *VhostContextIDAllocator {
+	return &VhostContextIDAllocator{
+		Options: DefaultContextIDOptions(),
+	}
+}
+
+// Allocate implements ContextIDAllocator.
+func (a *VhostContextIDAllocator) Allocate() (*os.File, uint64, error) {
+	f, cid, err := FindContextIDWithOptions(a.Options)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.allocated == nil {
+		a.allocated = make(map[uint64]allocatedContextID)
+	}
+	a.allocated[cid] = allocatedContextID{
+		file: f,
+		info: ContextIDInfo{
+			ContextID: cid,
+			Name:      a.Options.Name,
+			Allocated: time.Now(),
+		},
+	}
+
+	return f, cid, nil
+}
+
+// Release implements ContextIDAllocator. The context ID is free once the
+// VMM also closed its copy of the vhost file.
+func (a *VhostContextIDAllocator) Release(cid uint64) error {
+	a.mu.Lock()
+	allocated, ok := a.allocated[cid]
+	delete(a.allocated, cid)
+	a.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Context ID %d was not allocated", cid)
+	}
+
+	if a.Options.Registry != nil {
+		a.Options.Registry.Unregister(cid)
+	}
+
+	return allocated.file.Close()
+}
+
+// Snapshot returns the context IDs currently held by the allocator, sorted
+// by context ID. Names come from the registry of the allocator options when
+// there is one, so that renames are reflected.
+func (a *VhostContextIDAllocator) Snapshot() []ContextIDInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	infos := make([]ContextIDInfo, 0, len(a.allocated))
+	for cid, allocated := range a.allocated {
+		info := allocated.info
+		if a.Options.Registry != nil {
+			if name, ok := a.Options.Registry.Name(cid); ok {
+				info.Name = name
+			}
+		}
+		infos = append(infos, info)
+	}
+	sortContextIDInfos(infos)
+
+	return infos
+}
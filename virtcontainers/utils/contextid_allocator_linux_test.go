@@ -0,0 +1,224 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVhostContextIDAllocator(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return nil
+	}
+
+	var allocator ContextIDAllocator = NewVhostContextIDAllocator()
+
+	registry := NewContextIDRegistry()
+	a := allocator.(*VhostContextIDAllocator)
+	a.Options = ContextIDOptions{
+		Registry: registry,
+		Name:     "web-7",
+	}
+
+	f, cid, err := allocator.Allocate()
+	assert.NoError(err)
+	assert.NotNil(f)
+	assert.Equal(firstContextID, cid)
+	_, ok := registry.Name(cid)
+	assert.True(ok)
+
+	assert.NoError(allocator.Release(cid))
+	_, ok = registry.Name(cid)
+	assert.False(ok)
+
+	// The file was closed by Release.
+	assert.Error(f.Close())
+
+	assert.Error(allocator.Release(cid))
+
+	VHostVSockDevicePath = "/does/not/exist"
+	_, _, err = allocator.Allocate()
+	assert.Error(err)
+}
+
+func TestVhostContextIDAllocatorScanUnlocked(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	scanning := make(chan struct{})
+	resume := make(chan struct{})
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		close(scanning)
+		<-resume
+		return nil
+	}
+
+	allocator := NewVhostContextIDAllocator()
+
+	done := make(chan error)
+	go func() {
+		_, _, err := allocator.Allocate()
+		done <- err
+	}()
+
+	// The allocator is usable while a scan is in progress.
+	<-scanning
+	snapshot := make(chan []ContextIDInfo)
+	go func() {
+		snapshot <- allocator.Snapshot()
+	}()
+
+	select {
+	case infos := <-snapshot:
+		assert.Empty(infos)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Snapshot blocked by a scan")
+	}
+
+	close(resume)
+	assert.NoError(<-done)
+	assert.Len(allocator.Snapshot(), 1)
+}
+
+func TestMockContextIDAllocator(t *testing.T) {
+	assert := assert.New(t)
+
+	var allocator ContextIDAllocator = &MockContextIDAllocator{}
+
+	_, cid1, err := allocator.Allocate()
+	assert.NoError(err)
+	assert.Equal(uint64(3), cid1)
+
+	_, cid2, err := allocator.Allocate()
+	assert.NoError(err)
+	assert.Equal(uint64(4), cid2)
+
+	assert.NoError(allocator.Release(cid1))
+	assert.Error(allocator.Release(cid1))
+
+	_, cid3, err := allocator.Allocate()
+	assert.NoError(err)
+	assert.Equal(uint64(3), cid3)
+
+	allocator.(*MockContextIDAllocator).AllocateErr = errors.New("no context ID")
+	_, _, err = allocator.Allocate()
+	assert.Error(err)
+}
+
+func TestVhostContextIDAllocatorSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	// Every scan uses a new vhost file, the n-th scan gets the n-th
+	// context ID, as if the previous ones were held.
+	scans := 0
+	probes := 0
+	var lastFd uintptr
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		if fd != lastFd {
+			lastFd = fd
+			scans++
+			probes = 0
+		}
+		probes++
+		if probes < scans {
+			return errors.New("ioctl")
+		}
+		return nil
+	}
+
+	registry := NewContextIDRegistry()
+	a := &VhostContextIDAllocator{
+		Options: ContextIDOptions{
+			MaxContextID: 100,
+			Registry:     registry,
+		},
+	}
+	assert.Empty(a.Snapshot())
+
+	before := time.Now()
+	var cids []uint64
+	for _, name := range []string{"web-7", "web-8", "web-9"} {
+		a.Options.Name = name
+		_, cid, err := a.Allocate()
+		assert.NoError(err)
+		cids = append(cids, cid)
+	}
+
+	registry.Register(cids[0], "web-7-renamed")
+
+	snapshot := a.Snapshot()
+	assert.Len(snapshot, 3)
+	names := make(map[uint64]string)
+	for i, info := range snapshot {
+		if i > 0 {
+			assert.True(snapshot[i-1].ContextID < info.ContextID)
+		}
+		assert.False(info.Allocated.Before(before))
+		names[info.ContextID] = info.Name
+	}
+	assert.Equal("web-7-renamed", names[cids[0]])
+	assert.Equal("web-8", names[cids[1]])
+	assert.Equal("web-9", names[cids[2]])
+
+	assert.NoError(a.Release(cids[1]))
+	snapshot = a.Snapshot()
+	assert.Len(snapshot, 2)
+	for _, info := range snapshot {
+		assert.NotEqual(cids[1], info.ContextID)
+	}
+
+	for _, cid := range []uint64{cids[0], cids[2]} {
+		assert.NoError(a.Release(cid))
+	}
+	assert.Empty(a.Snapshot())
+}
+
+func TestMockContextIDAllocatorSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	m := &MockContextIDAllocator{}
+	assert.Empty(m.Snapshot())
+
+	for i := 0; i < 3; i++ {
+		_, _, err := m.Allocate()
+		assert.NoError(err)
+	}
+	assert.NoError(m.Release(4))
+
+	snapshot := m.Snapshot()
+	assert.Len(snapshot, 2)
+	assert.Equal(uint64(3), snapshot[0].ContextID)
+	assert.Equal(uint64(5), snapshot[1].ContextID)
+	assert.False(snapshot[0].Allocated.IsZero())
+}
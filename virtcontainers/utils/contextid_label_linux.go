@@ -0,0 +1,44 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// contextIDLabelBase is the base of the context ID labels, the largest one
+// strconv supports, so that labels only use lowercase letters and digits.
+const contextIDLabelBase = 36
+
+// ContextIDLabel returns the compact label of the context ID cid used in
+// logs, its base 36 representation, e.g. "1ekf" for 65535. Labels of
+// valid context IDs are at most 7 characters long, see
+// ParseContextIDLabel for the reverse.
+func ContextIDLabel(cid uint64) string {
+	return strconv.FormatUint(cid, contextIDLabelBase)
+}
+
+// ParseContextIDLabel returns the context ID whose label is label, see
+// ContextIDLabel. Only the labels of valid context IDs, as returned by
+// ContextIDLabel, are accepted, so that a context ID has a single label.
+func ParseContextIDLabel(label string) (uint64, error) {
+	cid, err := strconv.ParseUint(label, contextIDLabelBase, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid context ID label %q: %v", label, err)
+	}
+
+	if cid < firstContextID || cid > maxUInt {
+		return 0, fmt.Errorf("Invalid context ID label %q, context ID %d is not within [%d, %d]", label, cid, firstContextID, maxUInt)
+	}
+
+	// Reject the uppercase and zero padded variants.
+	if ContextIDLabel(cid) != label {
+		return 0, fmt.Errorf("Invalid context ID label %q, expected %q", label, ContextIDLabel(cid))
+	}
+
+	return cid, nil
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextIDLabel(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		cid   uint64
+		label string
+	}{
+		{firstContextID, "3"},
+		{35, "z"},
+		{36, "10"},
+		{65535, "1ekf"},
+		{maxUInt - 1, "1z141z2"},
+		{maxUInt, "1z141z3"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.label, ContextIDLabel(test.cid))
+
+		cid, err := ParseContextIDLabel(test.label)
+		assert.NoError(err, test.label)
+		assert.Equal(test.cid, cid, test.label)
+	}
+
+	for cid := firstContextID; cid < 100000; cid++ {
+		got, err := ParseContextIDLabel(ContextIDLabel(cid))
+		if !assert.NoError(err) || !assert.Equal(cid, got) {
+			break
+		}
+	}
+}
+
+func TestParseContextIDLabelInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, label := range []string{
+		"",
+		// Reserved context IDs
+		"0",
+		"1",
+		"2",
+		// Above maxUInt
+		"1z141z4",
+		"3w5e11264sgsf",
+		// Not the canonical label
+		"1EKF",
+		"01ekf",
+		"+1ekf",
+		"-3",
+		"1ekf ",
+		"1_000",
+	} {
+		_, err := ParseContextIDLabel(label)
+		assert.Error(err, label)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"sync"
+)
+
+// ContextIDRegistry maps context IDs to names, e.g. sandbox names, so that
+// logs can tell which sandbox a context ID belongs to. It is only meant
+// for observability and has no effect on the allocation of context IDs.
+// A ContextIDRegistry is safe for concurrent use, and its zero value is
+// ready to be used.
+type ContextIDRegistry struct {
+	mu    sync.RWMutex
+	names map[uint64]string
+}
+
+// NewContextIDRegistry returns an empty ContextIDRegistry.
+func NewContextIDRegistry() *ContextIDRegistry {
+	return &ContextIDRegistry{}
+}
+
+// Register associates name to the context ID cid, replacing the previous
+// name if any.
+func (r *ContextIDRegistry) Register(cid uint64, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names == nil {
+		r.names = make(map[uint64]string)
+	}
+	r.names[cid] = name
+}
+
+// Name returns the name associated to the context ID cid, and whether
+// there is one.
+func (r *ContextIDRegistry) Name(cid uint64) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name, ok := r.names[cid]
+	return name, ok
+}
+
+// Unregister removes the name associated to the context ID cid.
+func (r *ContextIDRegistry) Unregister(cid uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.names, cid)
+}
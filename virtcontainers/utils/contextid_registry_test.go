@@ -0,0 +1,76 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextIDRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	var r ContextIDRegistry
+
+	_, ok := r.Name(3)
+	assert.False(ok)
+
+	// Unregistering an unknown context ID is a no-op.
+	r.Unregister(3)
+
+	r.Register(3, "web-7")
+	name, ok := r.Name(3)
+	assert.True(ok)
+	assert.Equal("web-7", name)
+
+	r.Register(3, "web-8")
+	name, ok = r.Name(3)
+	assert.True(ok)
+	assert.Equal("web-8", name)
+
+	r.Unregister(3)
+	_, ok = r.Name(3)
+	assert.False(ok)
+}
+
+func TestContextIDRegistryConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	const workers = 16
+	const perWorker = 100
+
+	r := NewContextIDRegistry()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				cid := uint64(w*perWorker + i)
+				r.Register(cid, fmt.Sprintf("sandbox-%d", cid))
+				r.Name(cid)
+				if i%2 == 1 {
+					r.Unregister(cid)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for cid := uint64(0); cid < workers*perWorker; cid++ {
+		name, ok := r.Name(cid)
+		if cid%2 == 1 {
+			assert.False(ok)
+			continue
+		}
+		assert.True(ok)
+		assert.Equal(fmt.Sprintf("sandbox-%d", cid), name)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// devRoot is the path where device nodes are created.
+var devRoot = "/dev"
+
+var (
+	devIsDevtmpfsOnce sync.Once
+	devIsDevtmpfs     bool
+	devIsDevtmpfsErr  error
+)
+
+// errDeviceFound stops the walk of devRoot once the device is found.
+var errDeviceFound = errors.New("Device found")
+
+// DeviceNumbers returns the major and minor numbers of the device node
+// path, as used by /proc, /sys and /proc/self/mountinfo.
+func DeviceNumbers(path string) (uint32, uint32, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, 0, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK && st.Mode&unix.S_IFMT != unix.S_IFCHR {
+		return 0, 0, fmt.Errorf("%v is not a device node", path)
+	}
+
+	rdev := uint64(st.Rdev)
+	return unix.Major(rdev), unix.Minor(rdev), nil
+}
+
+// SameDevice returns true if the device nodes a and b, or the symbolic
+// links to them, e.g. /dev/sda1 and a /dev/disk/by-uuid link, are the same
+// device, whatever their names, e.g. to avoid attaching a device twice.
+func SameDevice(a, b string) (bool, error) {
+	var stA, stB unix.Stat_t
+
+	for _, d := range []struct {
+		path string
+		st   *unix.Stat_t
+	}{
+		{a, &stA},
+		{b, &stB},
+	} {
+		if err := unix.Stat(d.path, d.st); err != nil {
+			return false, &os.PathError{Op: "stat", Path: d.path, Err: err}
+		}
+
+		if d.st.Mode&unix.S_IFMT != unix.S_IFBLK && d.st.Mode&unix.S_IFMT != unix.S_IFCHR {
+			return false, fmt.Errorf("%v is not a device node", d.path)
+		}
+	}
+
+	// Block and character devices have separate numbers.
+	return stA.Mode&unix.S_IFMT == stB.Mode&unix.S_IFMT && stA.Rdev == stB.Rdev, nil
+}
+
+// ErrRefuseRootDevice is returned by the helpers destroying data, e.g.
+// ShredDevice, when asked to write to the device backing the root
+// filesystem, see IsRootDevice.
+var ErrRefuseRootDevice = errors.New("Refusing to write to the device backing the root filesystem")
+
+// IsRootDevice returns true if the block device disk backs the root
+// filesystem of the mount namespace of the current process, as found in
+// mountinfo, or is the disk holding the partition that does. Devices
+// stacked under the root device, e.g. by LVM, are not detected, nor is the
+// root device when mountinfo does not show it, e.g. in a chroot.
+func IsRootDevice(disk string) (bool, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(disk, &st); err != nil {
+		return false, &os.PathError{Op: "stat", Path: disk, Err: err}
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return false, fmt.Errorf("%v is not a block device", disk)
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return false, err
+	}
+
+	var root *MountInfo
+	for i := range mounts {
+		// The last one is on top.
+		if mounts[i].MountPoint == "/" {
+			root = &mounts[i]
+		}
+	}
+	if root == nil {
+		// Mounted outside of our view, e.g. in a chroot.
+		return false, nil
+	}
+
+	rdev := uint64(st.Rdev)
+	if unix.Major(rdev) == root.Major && unix.Minor(rdev) == root.Minor {
+		return true, nil
+	}
+
+	// Not a block device, e.g. overlay, tmpfs or btrfs.
+	rootName, err := sysfsDeviceName(root.Major, root.Minor)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	rootDisk, err := wholeDiskName(rootName)
+	if err != nil {
+		return false, err
+	}
+
+	name, err := blockDeviceName(disk)
+	if err != nil {
+		return false, err
+	}
+
+	return name == rootDisk, nil
+}
+
+// checkNotRootDevice returns ErrRefuseRootDevice if disk is the root
+// device, see IsRootDevice.
+func checkNotRootDevice(disk string) error {
+	root, err := IsRootDevice(disk)
+	if err != nil {
+		return err
+	}
+
+	if root {
+		return ErrRefuseRootDevice
+	}
+
+	return nil
+}
+
+// MakeDeviceNode creates the device node path for the block, or character,
+// device major:minor with the permissions of mode, whatever the umask, e.g.
+// for a device hotplugged in a guest without devtmpfs. An existing node is
+// fine as long as it is the same device, so that creating a node is
+// idempotent.
+func MakeDeviceNode(path string, major, minor uint32, mode os.FileMode, block bool) error {
+	fileType := uint32(unix.S_IFCHR)
+	if block {
+		fileType = unix.S_IFBLK
+	}
+
+	dev := unix.Mkdev(major, minor)
+	err := unix.Mknod(path, fileType|uint32(mode.Perm()), int(dev))
+	if err == unix.EEXIST {
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			return &os.PathError{Op: "stat", Path: path, Err: err}
+		}
+
+		if st.Mode&unix.S_IFMT != fileType || uint64(st.Rdev) != dev {
+			return fmt.Errorf("%v already exists and is not device %d:%d", path, major, minor)
+		}
+
+		return nil
+	} else if err != nil {
+		return &os.PathError{Op: "mknod", Path: path, Err: err}
+	}
+
+	return os.Chmod(path, mode.Perm())
+}
+
+// DevicePathFromNumbers returns the path of the block device node whose
+// major and minor numbers are major and minor, e.g. to resolve the devices
+// found in /proc/self/mountinfo. The name the kernel gives to the device in
+// sysfs is used when its node exists, otherwise the device nodes are looked
+// for.
+func DevicePathFromNumbers(major, minor uint32) (string, error) {
+	if name, err := sysfsDeviceName(major, minor); err == nil {
+		path := filepath.Join(devRoot, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	rdev := unix.Mkdev(major, minor)
+	found := ""
+
+	err := filepath.Walk(devRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Skip what cannot be read, e.g. restricted directories.
+			return nil
+		}
+		if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && uint64(st.Rdev) == rdev {
+			found = path
+			return errDeviceFound
+		}
+		return nil
+	})
+	if err != nil && err != errDeviceFound {
+		return "", err
+	}
+
+	if found == "" {
+		return "", fmt.Errorf("Could not find the block device %d:%d in %v", major, minor, devRoot)
+	}
+
+	return found, nil
+}
+
+// sysfsDeviceName returns the name of the block device major:minor, as
+// given by the DEVNAME entry of its uevent file.
+func sysfsDeviceName(major, minor uint32) (string, error) {
+	path := filepath.Join(sysfsRoot, "dev", "block", fmt.Sprintf("%d:%d", major, minor), "uevent")
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := strings.TrimPrefix(scanner.Text(), "DEVNAME="); name != scanner.Text() {
+			return name, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("No DEVNAME in %v", path)
+}
+
+// DevIsDevtmpfs returns true if /dev is a devtmpfs, where the kernel
+// creates the nodes of new devices, and false if it is static, e.g. a tmpfs
+// populated by a container engine, where waiting for a node to appear is
+// pointless. Since devtmpfs and tmpfs share the same magic number, the
+// filesystem type is taken from mountinfo. The result is only computed once.
+func DevIsDevtmpfs() (bool, error) {
+	devIsDevtmpfsOnce.Do(func() {
+		devIsDevtmpfs, devIsDevtmpfsErr = detectDevtmpfs(devRoot)
+	})
+
+	return devIsDevtmpfs, devIsDevtmpfsErr
+}
+
+func detectDevtmpfs(path string) (bool, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return false, err
+	}
+
+	// The last mount on path hides the previous ones. When nothing is
+	// mounted on path, it is a plain directory of the root filesystem.
+	fstype := ""
+	for _, m := range mounts {
+		if m.MountPoint == path {
+			fstype = m.FSType
+		}
+	}
+
+	return fstype == "devtmpfs", nil
+}
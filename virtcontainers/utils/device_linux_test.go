@@ -0,0 +1,295 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	ktu "github.com/kata-containers/runtime/pkg/katatestutils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestDeviceNumbers(t *testing.T) {
+	assert := assert.New(t)
+
+	major, minor, err := DeviceNumbers("/dev/null")
+	assert.NoError(err)
+	assert.Equal(uint32(1), major)
+	assert.Equal(uint32(3), minor)
+
+	_, _, err = DeviceNumbers("/does/not/exist")
+	assert.Error(err)
+	assert.True(os.IsNotExist(err))
+
+	f, err := ioutil.TempFile("", "device")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+	f.Close()
+
+	_, _, err = DeviceNumbers(f.Name())
+	assert.Error(err)
+}
+
+func TestSameDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dev")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	link := filepath.Join(dir, "null")
+	assert.NoError(os.Symlink("/dev/null", link))
+
+	same, err := SameDevice("/dev/null", link)
+	assert.NoError(err)
+	assert.True(same)
+
+	same, err = SameDevice(link, "/dev/zero")
+	assert.NoError(err)
+	assert.False(same)
+
+	file := filepath.Join(dir, "file")
+	assert.NoError(ioutil.WriteFile(file, nil, 0644))
+
+	_, err = SameDevice("/dev/null", file)
+	assert.Error(err)
+	_, err = SameDevice(filepath.Join(dir, "does-not-exist"), "/dev/null")
+	assert.Error(err)
+
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	loop, cleanup := setupLoopDevice(t, 1<<20)
+	defer cleanup()
+
+	loopLink := filepath.Join(dir, "loop")
+	assert.NoError(os.Symlink(loop, loopLink))
+
+	same, err = SameDevice(loopLink, loop)
+	assert.NoError(err)
+	assert.True(same)
+
+	// A character device with the numbers of the loop device
+	major, minor, err := DeviceNumbers(loop)
+	assert.NoError(err)
+	char := filepath.Join(dir, "char")
+	assert.NoError(MakeDeviceNode(char, major, minor, 0600, false))
+
+	same, err = SameDevice(loop, char)
+	assert.NoError(err)
+	assert.False(same)
+}
+
+func TestIsRootDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	orgMountInfoPath := mountInfoPath
+	defer func() {
+		mountInfoPath = orgMountInfoPath
+	}()
+
+	mountInfo, err := ioutil.TempFile("", "mountinfo")
+	assert.NoError(err)
+	defer os.Remove(mountInfo.Name())
+	mountInfo.Close()
+	mountInfoPath = mountInfo.Name()
+
+	setRoot := func(major, minor uint32) {
+		content := fmt.Sprintf("20 1 %d:%d / / rw - ext4 /dev/root rw\n"+
+			"24 20 0:5 / /dev rw - devtmpfs devtmpfs rw\n", major, minor)
+		assert.NoError(ioutil.WriteFile(mountInfoPath, []byte(content), 0644))
+	}
+
+	_, err = IsRootDevice("/does/not/exist")
+	assert.Error(err)
+
+	// Not a block device
+	_, err = IsRootDevice("/dev/null")
+	assert.Error(err)
+
+	loop, cleanup := setupLoopDevice(t, 4<<20)
+	defer cleanup()
+
+	major, minor, err := DeviceNumbers(loop)
+	assert.NoError(err)
+
+	setRoot(major, minor)
+	root, err := IsRootDevice(loop)
+	assert.NoError(err)
+	assert.True(root)
+
+	// Destructive helpers refuse it.
+	assert.Equal(ErrRefuseRootDevice, ShredDevice(loop, 1))
+	assert.Equal(ErrRefuseRootDevice, ZeroOutDevice(loop, 0, 4096))
+	_, _, err = QuickDeviceBenchmarkWithOptions(loop, 4096, DeviceBenchmarkOptions{Write: true})
+	assert.Equal(ErrRefuseRootDevice, err)
+
+	// Overlay root
+	setRoot(0, 42)
+	root, err = IsRootDevice(loop)
+	assert.NoError(err)
+	assert.False(root)
+
+	// Root on a partition of the disk
+	sysfs, sysfsCleanup := newTestSysfs(t)
+	defer sysfsCleanup()
+
+	name := filepath.Base(loop)
+	sysfs.addDisk(name, nil)
+	sysfs.addPartition(name, name+"p1", nil)
+	sysfs.addDisk("sda", nil)
+	sysfs.writeAttrs(filepath.Join(sysfs.root, "dev", "block"), map[string]string{
+		"259:1/uevent": "MAJOR=259\nMINOR=1\nDEVNAME=" + name + "p1",
+		"8:0/uevent":   "MAJOR=8\nMINOR=0\nDEVNAME=sda",
+	})
+
+	setRoot(259, 1)
+	root, err = IsRootDevice(loop)
+	assert.NoError(err)
+	assert.True(root)
+
+	setRoot(8, 0)
+	root, err = IsRootDevice(loop)
+	assert.NoError(err)
+	assert.False(root)
+
+	// Root not shown, e.g. in a chroot
+	assert.NoError(ioutil.WriteFile(mountInfoPath, []byte("24 20 0:5 / /dev rw - devtmpfs devtmpfs rw\n"), 0644))
+	root, err = IsRootDevice(loop)
+	assert.NoError(err)
+	assert.False(root)
+
+	os.Remove(mountInfoPath)
+	_, err = IsRootDevice(loop)
+	assert.Error(err)
+}
+
+func TestMakeDeviceNode(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dev")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Not a directory
+	assert.Error(MakeDeviceNode(filepath.Join(dir, "does-not-exist", "null"), 1, 3, 0666, false))
+
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	null := filepath.Join(dir, "null")
+	assert.NoError(MakeDeviceNode(null, 1, 3, 0666, false))
+
+	fi, err := os.Stat(null)
+	assert.NoError(err)
+	assert.Equal(os.ModeDevice|os.ModeCharDevice|0666, fi.Mode())
+
+	major, minor, err := DeviceNumbers(null)
+	assert.NoError(err)
+	assert.Equal(uint32(1), major)
+	assert.Equal(uint32(3), minor)
+
+	// Same device
+	assert.NoError(MakeDeviceNode(null, 1, 3, 0600, false))
+
+	// Another device
+	assert.Error(MakeDeviceNode(null, 1, 5, 0666, false))
+	assert.Error(MakeDeviceNode(null, 1, 3, 0666, true))
+
+	file := filepath.Join(dir, "file")
+	assert.NoError(ioutil.WriteFile(file, nil, 0644))
+	assert.Error(MakeDeviceNode(file, 1, 3, 0666, false))
+}
+
+func TestDevicePathFromNumbers(t *testing.T) {
+	assert := assert.New(t)
+
+	s, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	orgDevRoot := devRoot
+	defer func() {
+		devRoot = orgDevRoot
+	}()
+	devRoot = s.dev
+
+	loop0 := s.addDisk("loop0", nil)
+	s.writeAttrs(filepath.Join(s.root, "dev", "block", "7:0"), map[string]string{
+		"uevent": "MAJOR=7\nMINOR=0\nDEVNAME=loop0\nDEVTYPE=disk",
+	})
+
+	path, err := DevicePathFromNumbers(7, 0)
+	assert.NoError(err)
+	assert.Equal(loop0, path)
+
+	_, err = DevicePathFromNumbers(7, 1)
+	assert.Error(err)
+
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	// Without sysfs, the device nodes are scanned.
+	sub := filepath.Join(s.dev, "sub")
+	assert.NoError(os.MkdirAll(sub, 0755))
+	node := filepath.Join(sub, "fake")
+	assert.NoError(unix.Mknod(node, unix.S_IFBLK|0600, int(unix.Mkdev(7, 1))))
+
+	path, err = DevicePathFromNumbers(7, 1)
+	assert.NoError(err)
+	assert.Equal(node, path)
+}
+
+func TestDevIsDevtmpfs(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "devtmpfs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	orgMountInfoPath := mountInfoPath
+	defer func() {
+		mountInfoPath = orgMountInfoPath
+		devIsDevtmpfsOnce = sync.Once{}
+	}()
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+
+	tests := []struct {
+		mountInfo string
+		expected  bool
+	}{
+		{"22 1 0:5 / /dev rw,nosuid - devtmpfs devtmpfs rw,size=8116636k\n", true},
+		{"22 1 0:5 / /dev rw,nosuid - tmpfs tmpfs rw,size=65536k\n", false},
+		{"22 1 0:5 / /dev rw - devtmpfs devtmpfs rw\n23 22 0:6 / /dev rw - tmpfs tmpfs rw\n", false},
+		{"21 1 8:1 / / rw - ext4 /dev/sda1 rw\n", false},
+		{"22 1 0:5 / /dev/pts rw - devpts devpts rw\n", false},
+	}
+
+	for _, test := range tests {
+		assert.NoError(ioutil.WriteFile(mountInfoPath, []byte(test.mountInfo), 0644))
+		devtmpfs, err := detectDevtmpfs("/dev")
+		assert.NoError(err)
+		assert.Equal(test.expected, devtmpfs, test.mountInfo)
+	}
+
+	os.Remove(mountInfoPath)
+	devIsDevtmpfsOnce = sync.Once{}
+	_, err = DevIsDevtmpfs()
+	assert.Error(err)
+
+	// The first result sticks.
+	mountInfoPath = orgMountInfoPath
+	_, err2 := DevIsDevtmpfs()
+	assert.Equal(err, err2)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SendFDs sends the file descriptors of files over conn, all of them in a
+// single SCM_RIGHTS control message.
+func SendFDs(conn *net.UnixConn, files []*os.File) error {
+	if len(files) == 0 {
+		return fmt.Errorf("No file descriptor to send")
+	}
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+
+	// Stream sockets do not carry control messages without data.
+	n, oobn, err := conn.WriteMsgUnix([]byte{0}, unix.UnixRights(fds...), nil)
+	if err != nil {
+		return err
+	}
+
+	if n != 1 || oobn != len(unix.UnixRights(fds...)) {
+		return fmt.Errorf("Short write sending %d file descriptors", len(files))
+	}
+
+	return nil
+}
+
+// RecvFDs receives n file descriptors sent over conn in a single SCM_RIGHTS
+// control message, as SendFDs does. The returned files are close-on-exec
+// and it's the caller's responsibility to close them.
+func RecvFDs(conn *net.UnixConn, n int) ([]*os.File, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("Invalid number of file descriptors %d", n)
+	}
+
+	buf := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(n*4))
+
+	_, oobn, flags, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []int
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			CleanupFds(filesFromFds(fds), len(fds))
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+
+	files := filesFromFds(fds)
+
+	if flags&unix.MSG_CTRUNC != 0 || len(files) != n {
+		CleanupFds(files, len(files))
+		return nil, fmt.Errorf("Expected %d file descriptors, got %d", n, len(files))
+	}
+
+	return files, nil
+}
+
+func filesFromFds(fds []int) []*os.File {
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		unix.CloseOnExec(fd)
+		files[i] = os.NewFile(uintptr(fd), fmt.Sprintf("fd-%d", fd))
+	}
+
+	return files
+}
+
+// IsValidFD returns true if fd is an open file descriptor. Checking a file
+// descriptor before handing it over, e.g. the vhost-vsock one to the VMM,
+// turns a confusing failure on the other side into a clear error here.
+func IsValidFD(fd uintptr) bool {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFD, 0)
+	return errno == 0
+}
+
+// ClearCloseOnExec clears the close-on-exec flag of f, which Go sets on
+// every file it opens, so that f is inherited by the programs executed
+// afterwards, e.g. a VMM handed the vhost-vsock file descriptor. This is
+// not needed for the files passed through exec.Cmd.ExtraFiles, and it
+// leaks f into every program executed until f is closed, whatever starts
+// it.
+func ClearCloseOnExec(f *os.File) error {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFD, 0)
+	if errno != 0 {
+		return os.NewSyscallError("fcntl", errno)
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, flags&^syscall.FD_CLOEXEC); errno != 0 {
+		return os.NewSyscallError("fcntl", errno)
+	}
+
+	return nil
+}
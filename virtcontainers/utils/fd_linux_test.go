@@ -0,0 +1,142 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// socketPair returns both ends of a connected unix socket.
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+
+	return conns[0], conns[1]
+}
+
+func TestSendRecvFDs(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b := socketPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	var readers, writers []*os.File
+	for i := 0; i < 3; i++ {
+		r, w, err := os.Pipe()
+		assert.NoError(err)
+		defer r.Close()
+		defer w.Close()
+		readers = append(readers, r)
+		writers = append(writers, w)
+	}
+
+	err := SendFDs(a, writers)
+	assert.NoError(err)
+
+	files, err := RecvFDs(b, len(writers))
+	assert.NoError(err)
+	assert.Len(files, len(writers))
+
+	// Writing to the received files reaches the original pipes.
+	for i, f := range files {
+		_, err := f.Write([]byte{byte('a' + i)})
+		assert.NoError(err)
+		f.Close()
+		writers[i].Close()
+
+		data, err := ioutil.ReadAll(readers[i])
+		assert.NoError(err)
+		assert.Equal([]byte{byte('a' + i)}, data)
+	}
+}
+
+func TestRecvFDsMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	a, b := socketPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	r, w, err := os.Pipe()
+	assert.NoError(err)
+	defer r.Close()
+	defer w.Close()
+
+	err = SendFDs(a, []*os.File{r, w})
+	assert.NoError(err)
+
+	// Room for a single descriptor only.
+	_, err = RecvFDs(b, 1)
+	assert.Error(err)
+
+	assert.Error(SendFDs(a, nil))
+
+	_, err = RecvFDs(b, 0)
+	assert.Error(err)
+}
+
+func TestIsValidFD(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "fd")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	fd := f.Fd()
+	assert.True(IsValidFD(fd))
+
+	f.Close()
+	assert.False(IsValidFD(fd))
+
+	assert.True(IsValidFD(os.Stdin.Fd()))
+	assert.False(IsValidFD(^uintptr(0)))
+}
+
+func TestClearCloseOnExec(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "fd")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	fdFlags := func() uintptr {
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFD, 0)
+		assert.Zero(errno)
+		return flags
+	}
+
+	assert.NotZero(fdFlags() & syscall.FD_CLOEXEC)
+
+	assert.NoError(ClearCloseOnExec(f))
+	assert.Zero(fdFlags() & syscall.FD_CLOEXEC)
+
+	// Already cleared
+	assert.NoError(ClearCloseOnExec(f))
+
+	f.Close()
+	assert.Error(ClearCloseOnExec(f))
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"os"
+)
+
+// Kind is the type of a file, as reported by lstat(2).
+type Kind int
+
+const (
+	// KindUnknown is a file of a type not listed below.
+	KindUnknown Kind = iota
+
+	// KindRegular is a regular file.
+	KindRegular
+
+	// KindDir is a directory.
+	KindDir
+
+	// KindSymlink is a symbolic link.
+	KindSymlink
+
+	// KindBlockDevice is a block device node.
+	KindBlockDevice
+
+	// KindCharDevice is a character device node.
+	KindCharDevice
+
+	// KindFifo is a named pipe.
+	KindFifo
+
+	// KindSocket is a UNIX domain socket.
+	KindSocket
+)
+
+var kindNames = map[Kind]string{
+	KindUnknown:     "unknown file",
+	KindRegular:     "regular file",
+	KindDir:         "directory",
+	KindSymlink:     "symbolic link",
+	KindBlockDevice: "block device",
+	KindCharDevice:  "character device",
+	KindFifo:        "fifo",
+	KindSocket:      "socket",
+}
+
+// String returns the name of k, as used in error messages.
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+
+	return kindNames[KindUnknown]
+}
+
+// fileKindOf returns the kind of file whose mode is mode.
+func fileKindOf(mode os.FileMode) Kind {
+	switch {
+	case mode.IsRegular():
+		return KindRegular
+	case mode.IsDir():
+		return KindDir
+	case mode&os.ModeSymlink != 0:
+		return KindSymlink
+	case mode&os.ModeCharDevice != 0:
+		return KindCharDevice
+	case mode&os.ModeDevice != 0:
+		return KindBlockDevice
+	case mode&os.ModeNamedPipe != 0:
+		return KindFifo
+	case mode&os.ModeSocket != 0:
+		return KindSocket
+	default:
+		return KindUnknown
+	}
+}
+
+// FileKind returns the kind of the file path. Symbolic links are not
+// followed, e.g. FileKind returns KindSymlink for /dev/disk/by-uuid links:
+// callers expecting a device should resolve them first.
+func FileKind(path string) (Kind, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return KindUnknown, err
+	}
+
+	return fileKindOf(fi.Mode()), nil
+}
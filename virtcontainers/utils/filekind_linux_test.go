@@ -0,0 +1,84 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileKind(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kind")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	assert.NoError(ioutil.WriteFile(file, nil, 0644))
+
+	link := filepath.Join(dir, "link")
+	assert.NoError(os.Symlink("/dev/null", link))
+
+	fifo := filepath.Join(dir, "fifo")
+	assert.NoError(syscall.Mkfifo(fifo, 0644))
+
+	socket := filepath.Join(dir, "socket")
+	l, err := net.Listen("unix", socket)
+	assert.NoError(err)
+	defer l.Close()
+
+	tests := []struct {
+		path string
+		kind Kind
+	}{
+		{file, KindRegular},
+		{dir, KindDir},
+		{link, KindSymlink},
+		{fifo, KindFifo},
+		{socket, KindSocket},
+		{"/dev/null", KindCharDevice},
+	}
+
+	for _, test := range tests {
+		kind, err := FileKind(test.path)
+		assert.NoError(err, test.path)
+		assert.Equal(test.kind, kind, test.path)
+	}
+
+	_, err = FileKind(filepath.Join(dir, "does-not-exist"))
+	assert.Error(err)
+
+	r, w, err := os.Pipe()
+	assert.NoError(err)
+	defer r.Close()
+	defer w.Close()
+
+	fi, err := r.Stat()
+	assert.NoError(err)
+	assert.Equal(KindFifo, fileKindOf(fi.Mode()))
+
+	loop, cleanup := setupLoopDevice(t, 1<<20)
+	defer cleanup()
+
+	kind, err := FileKind(loop)
+	assert.NoError(err)
+	assert.Equal(KindBlockDevice, kind)
+}
+
+func TestKindString(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("block device", KindBlockDevice.String())
+	assert.Equal("fifo", KindFifo.String())
+	assert.Equal("unknown file", Kind(42).String())
+}
@@ -0,0 +1,548 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// from <linux/magic.h>
+const (
+	tmpfsMagic        = 0x01021994
+	cgroupSuperMagic  = 0x27e0eb
+	cgroup2SuperMagic = 0x63677270
+)
+
+// cgroupMountPoint is the path where the cgroup hierarchy is mounted.
+var cgroupMountPoint = "/sys/fs/cgroup"
+
+// procFilesystemsPath lists the filesystems registered in the kernel.
+var procFilesystemsPath = "/proc/filesystems"
+
+// kernelModulesDir holds the modules of every installed kernel.
+var kernelModulesDir = "/lib/modules"
+
+var (
+	cgroupVersionOnce sync.Once
+	cgroupVersion     int
+	cgroupVersionErr  error
+)
+
+// blkidVersionRegex matches the output of blkid -V, e.g.
+// "blkid from util-linux 2.34  (libblkid 2.34.0, 14-Jun-2019)".
+var blkidVersionRegex = regexp.MustCompile(`util-linux(?:-ng)? (\d+)\.(\d+)`)
+
+// blkidNotFoundStatus is the exit status of blkid when the device cannot
+// be identified or when it has none of the requested tags.
+const blkidNotFoundStatus = 2
+
+var (
+	blkidVersionOnce  sync.Once
+	blkidVersionMajor int
+	blkidVersionMinor int
+	blkidVersionErr   error
+)
+
+// filesystemMagic returns the magic number of the filesystem path is on.
+func filesystemMagic(path string) (int64, error) {
+	var st unix.Statfs_t
+
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return int64(st.Type), nil
+}
+
+// CgroupVersion returns 2 if the host uses the unified cgroup hierarchy,
+// or 1 if it uses the legacy (or hybrid) hierarchy. The version is
+// detected from the filesystem type of /sys/fs/cgroup and, since it cannot
+// change without a reboot, is only detected once.
+func CgroupVersion() (int, error) {
+	cgroupVersionOnce.Do(func() {
+		cgroupVersion, cgroupVersionErr = detectCgroupVersion(cgroupMountPoint)
+	})
+
+	return cgroupVersion, cgroupVersionErr
+}
+
+func detectCgroupVersion(path string) (int, error) {
+	magic, err := filesystemMagic(path)
+	if err != nil {
+		return 0, err
+	}
+
+	switch magic {
+	case cgroup2SuperMagic:
+		return 2, nil
+	case tmpfsMagic, cgroupSuperMagic:
+		// cgroup v1 controllers are mounted on a tmpfs, or
+		// directly on a cgroup filesystem.
+		return 1, nil
+	}
+
+	return 0, fmt.Errorf("Unexpected filesystem type %#x for cgroup mount point %s", magic, path)
+}
+
+// runCommand runs an external tool and returns its combined output.
+// It is a variable so tests can replace it.
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// BlkidVersion returns the major and minor version of the blkid tool,
+// that is the version of util-linux it comes from, so that callers can
+// pick the flags it supports. The version is only detected once.
+func BlkidVersion() (int, int, error) {
+	blkidVersionOnce.Do(func() {
+		blkidVersionMajor, blkidVersionMinor, blkidVersionErr = detectBlkidVersion()
+	})
+
+	return blkidVersionMajor, blkidVersionMinor, blkidVersionErr
+}
+
+func detectBlkidVersion() (int, int, error) {
+	out, err := runCommand("blkid", "-V")
+	if err != nil {
+		return 0, 0, fmt.Errorf("Could not get blkid version: %v: %s", err, out)
+	}
+
+	match := blkidVersionRegex.FindSubmatch(out)
+	if match == nil {
+		return 0, 0, fmt.Errorf("Unexpected blkid version %q", strings.TrimSpace(string(out)))
+	}
+
+	major, err := strconv.Atoi(string(match[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	minor, err := strconv.Atoi(string(match[2]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return major, minor, nil
+}
+
+// DeviceLabel returns the label of the filesystem on disk, mounted or
+// not, or "" if it has none. The label is probed with blkid, or read from
+// the superblock of ext2/3/4, XFS and FAT filesystems if blkid is not
+// available.
+func DeviceLabel(disk string) (string, error) {
+	if _, err := os.Stat(disk); err != nil {
+		return "", err
+	}
+
+	out, err := runCommand("blkid", "-p", "-s", "LABEL", "-o", "value", disk)
+	if err == nil {
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if _, ok := err.(*exec.Error); !ok {
+		// blkid fails when disk has no label, but also when it holds
+		// no filesystem blkid knows of.
+		if exitErr, ok := err.(*exec.ExitError); ok && len(bytes.TrimSpace(out)) == 0 {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == blkidNotFoundStatus {
+				return "", nil
+			}
+		}
+		return "", fmt.Errorf("Could not get label of %s: %v: %s", disk, err, out)
+	}
+
+	f, err := os.Open(disk)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	label, err := readFilesystemLabel(f, 0)
+	if err != nil {
+		return "", fmt.Errorf("Could not get label of %s: %v", disk, err)
+	}
+
+	return label, nil
+}
+
+// ProbeFSTypeAt returns the type of the filesystem starting offset bytes
+// into disk, a block device or a disk image, e.g. in a partition of a disk
+// image, without setting up a loop device for it. Only ext2/3/4, XFS and
+// FAT filesystems are recognized, from their superblock.
+func ProbeFSTypeAt(disk string, offset int64) (string, error) {
+	f, err := os.Open(disk)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	size, err := deviceSize(f)
+	if err != nil {
+		return "", err
+	}
+
+	if offset < 0 || offset >= size {
+		return "", fmt.Errorf("Invalid offset %d, %v is %d bytes long", offset, disk, size)
+	}
+
+	fstype, err := probeFSType(f, offset)
+	if err != nil {
+		return "", fmt.Errorf("Could not probe %v at %d: %v", disk, offset, err)
+	}
+
+	if fstype == "" {
+		return "", fmt.Errorf("No supported filesystem found on %v at %d", disk, offset)
+	}
+
+	return fstype, nil
+}
+
+type labelTool struct {
+	maxLen int
+	args   func(disk, label string) (string, []string)
+}
+
+var labelTools = map[string]labelTool{
+	"ext2": {16, e2labelArgs},
+	"ext3": {16, e2labelArgs},
+	"ext4": {16, e2labelArgs},
+	"xfs": {12, func(disk, label string) (string, []string) {
+		return "xfs_admin", []string{"-L", label, disk}
+	}},
+	"vfat": {11, fatlabelArgs},
+	"fat":  {11, fatlabelArgs},
+}
+
+func e2labelArgs(disk, label string) (string, []string) {
+	return "e2label", []string{disk, label}
+}
+
+func fatlabelArgs(disk, label string) (string, []string) {
+	return "fatlabel", []string{disk, label}
+}
+
+// SetFilesystemLabel sets the label of the fstype filesystem on disk,
+// using the relabeling tool of that filesystem. The filesystem must not
+// be mounted for xfs. An ErrUnsafeArgument is returned if disk or label
+// could be mistaken for options of the tool, see ValidateArgument.
+func SetFilesystemLabel(disk, fstype, label string) error {
+	if disk == "" {
+		return fmt.Errorf("Disk cannot be empty")
+	}
+
+	if err := ValidateArgument("disk", disk); err != nil {
+		return err
+	}
+
+	if err := ValidateArgument("label", label); err != nil {
+		return err
+	}
+
+	if fstype == "" {
+		return fmt.Errorf("Filesystem type of %s must be specified", disk)
+	}
+
+	tool, ok := labelTools[fstype]
+	if !ok {
+		return fmt.Errorf("Relabeling %s filesystems is not supported", fstype)
+	}
+
+	if len(label) > tool.maxLen {
+		return fmt.Errorf("Label %q is too long for %s (got %d bytes, max %d)", label, fstype, len(label), tool.maxLen)
+	}
+
+	name, args := tool.args(disk, label)
+	if out, err := runCommand(name, args...); err != nil {
+		return fmt.Errorf("Could not set label of %s: %v: %s", disk, err, out)
+	}
+
+	return nil
+}
+
+// GrowFilesystem grows the filesystem mounted on mountPoint to the size of
+// its device, e.g. after the backing device was resized, without
+// unmounting it. Only ext2/3/4, xfs and btrfs filesystems, which all
+// support growing online, are supported. Filesystems are never shrunk: an
+// ext filesystem larger than its device is refused, and the xfs and btrfs
+// tools can only grow them to the size of their devices.
+func GrowFilesystem(mountPoint string) error {
+	if err := ValidateArgument("mount point", mountPoint); err != nil {
+		return err
+	}
+
+	m, err := findMount(mountPoint)
+	if err != nil {
+		return err
+	}
+
+	var name string
+	var args []string
+
+	switch m.FSType {
+	case "ext2", "ext3", "ext4":
+		// resize2fs only takes the device of mounted filesystems.
+		disk, err := DeviceForMount(mountPoint)
+		if err != nil {
+			return err
+		}
+
+		if err := checkNotShrinking(disk, m.MountPoint); err != nil {
+			return err
+		}
+
+		name, args = "resize2fs", []string{disk}
+	case "xfs":
+		name, args = "xfs_growfs", []string{m.MountPoint}
+	case "btrfs":
+		name, args = "btrfs", []string{"filesystem", "resize", "max", m.MountPoint}
+	default:
+		return fmt.Errorf("Growing %s filesystems online is not supported", m.FSType)
+	}
+
+	if out, err := runCommand(name, args...); err != nil {
+		return fmt.Errorf("Could not grow %s filesystem mounted on %v: %v: %s", m.FSType, mountPoint, err, out)
+	}
+
+	return nil
+}
+
+// checkNotShrinking returns an error if the filesystem mounted on
+// mountPoint does not fit in disk anymore, in which case resizing it to the
+// size of disk would shrink it.
+func checkNotShrinking(disk, mountPoint string) error {
+	size, err := GetBlockDeviceSize(disk)
+	if err != nil {
+		return err
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountPoint, &st); err != nil {
+		return &os.PathError{Op: "statfs", Path: mountPoint, Err: err}
+	}
+
+	// The filesystem metadata is not accounted for, the actual
+	// filesystem is even larger.
+	fsSize := st.Blocks * uint64(st.Bsize)
+	if fsSize > size {
+		return fmt.Errorf("Filesystem mounted on %v is larger than %v (%d > %d bytes), refusing to shrink it", mountPoint, disk, fsSize, size)
+	}
+
+	return nil
+}
+
+// recommendedMountOptions are the mount options recommended per filesystem
+// type, see RecommendedMountOptions.
+var recommendedMountOptions = map[string][]string{
+	// Remount read-only on errors instead of carrying on, whatever the
+	// default recorded in the superblock.
+	"ext2": {"errors=remount-ro"},
+	"ext3": {"errors=remount-ro"},
+	"ext4": {"errors=remount-ro"},
+
+	// Snapshots and clones of an XFS filesystem share its UUID, which XFS
+	// refuses to mount twice.
+	"xfs": {"nouuid"},
+
+	// Optical media cannot be written.
+	"iso9660": {"ro"},
+	"udf":     {"ro"},
+}
+
+// RecommendedMountOptions returns the mount options recommended for fstype
+// filesystems, to be merged with the options of the caller. The options are
+// kept conservative: they avoid failures or data loss and never change what
+// is written to disk, so e.g. btrfs compression is left to callers. It
+// returns nil when there is nothing to recommend.
+func RecommendedMountOptions(fstype string) []string {
+	options, ok := recommendedMountOptions[fstype]
+	if !ok {
+		return nil
+	}
+
+	return append([]string(nil), options...)
+}
+
+// FilesystemSupported returns true if the running kernel can mount fstype
+// filesystems, either because the filesystem is already registered (built
+// in or module loaded) or because a module providing it is available and
+// will be loaded by the kernel on the first mount.
+func FilesystemSupported(fstype string) (bool, error) {
+	if fstype == "" {
+		return false, fmt.Errorf("Filesystem type cannot be empty")
+	}
+
+	registered, err := filesystemRegistered(fstype)
+	if err != nil || registered {
+		return registered, err
+	}
+
+	release, err := runningKernelRelease()
+	if err != nil {
+		return false, err
+	}
+
+	// The kernel asks for the "fs-<type>" module alias when mounting
+	// a filesystem type it does not know about yet.
+	alias := "fs-" + fstype
+	for _, f := range []string{"modules.alias", "modules.builtin.alias"} {
+		found, err := moduleAliasExists(filepath.Join(kernelModulesDir, release, f), alias)
+		if err != nil || found {
+			return found, err
+		}
+	}
+
+	return false, nil
+}
+
+// filesystemRegistered looks for fstype in /proc/filesystems. Every line
+// is a filesystem name, prefixed by "nodev" for filesystems that are not
+// backed by a block device.
+func filesystemRegistered(fstype string) (bool, error) {
+	f, err := os.Open(procFilesystemsPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[len(fields)-1] == fstype {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// moduleAliasExists looks for alias in a modules.alias formatted file. A
+// missing file is not an error, the modules might not be installed.
+func moduleAliasExists(path, alias string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 && fields[0] == "alias" && fields[1] == alias {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// kernelRelease returns the release of the running kernel, as uname -r does.
+func kernelRelease() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", err
+	}
+
+	return string(uts.Release[:clen(uts.Release[:])]), nil
+}
+
+// clen returns the index of the first NULL byte in n, or len(n).
+func clen(n []byte) int {
+	for i := 0; i < len(n); i++ {
+		if n[i] == 0 {
+			return i
+		}
+	}
+
+	return len(n)
+}
+
+// ImageFileUsage returns the apparent size of the image file path, as seen
+// by the guest, and the storage it actually uses on the host, which is
+// smaller for sparse files.
+func ImageFileUsage(path string) (int64, int64, error) {
+	var st unix.Stat_t
+
+	if err := unix.Lstat(path, &st); err != nil {
+		return 0, 0, err
+	}
+
+	// st_blocks is always in 512 bytes units.
+	return st.Size, st.Blocks * 512, nil
+}
+
+// OverlaySupported returns true if the kernel can mount overlay filesystems.
+func OverlaySupported() (bool, error) {
+	return FilesystemSupported("overlay")
+}
+
+// OverlayFeatures returns the default state of the optional overlay
+// filesystem features, e.g. "metacopy" or "redirect_dir", as set by the
+// parameters of the overlay module. Parameters that do not enable or
+// disable a feature are ignored. The module parameters only exist once
+// the overlay filesystem is registered, which happens on its first mount
+// when it is built as a module.
+func OverlayFeatures() (map[string]bool, error) {
+	dir := filepath.Join(sysfsRoot, "module", "overlay", "parameters")
+
+	params, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, errors.New("Overlay module is not loaded")
+	} else if err != nil {
+		return nil, err
+	}
+
+	features := make(map[string]bool)
+	for _, p := range params {
+		data, err := ioutil.ReadFile(filepath.Join(dir, p.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		switch strings.TrimSpace(string(data)) {
+		case "Y":
+			features[p.Name()] = true
+		case "N":
+			features[p.Name()] = false
+		}
+	}
+
+	return features, nil
+}
+
+// SameFilesystem returns true if paths a and b are on the same filesystem,
+// so that a can be hard linked or atomically renamed to b.
+func SameFilesystem(a, b string) (bool, error) {
+	var stA, stB unix.Stat_t
+
+	if err := unix.Stat(a, &stA); err != nil {
+		return false, &os.PathError{Op: "stat", Path: a, Err: err}
+	}
+
+	if err := unix.Stat(b, &stB); err != nil {
+		return false, &os.PathError{Op: "stat", Path: b, Err: err}
+	}
+
+	return stA.Dev == stB.Dev, nil
+}
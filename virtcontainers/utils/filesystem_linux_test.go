@@ -0,0 +1,639 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectCgroupVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	// /dev/shm is a tmpfs, as the legacy cgroup mount point is.
+	if magic, err := filesystemMagic("/dev/shm"); err == nil && magic == tmpfsMagic {
+		v, err := detectCgroupVersion("/dev/shm")
+		assert.NoError(err)
+		assert.Equal(1, v)
+	}
+
+	_, err := detectCgroupVersion("/does/not/exist")
+	assert.Error(err)
+
+	dir, err := ioutil.TempDir("", "cgroup")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	if magic, err := filesystemMagic(dir); err == nil && magic != tmpfsMagic {
+		_, err = detectCgroupVersion(dir)
+		assert.Error(err)
+	}
+}
+
+func TestCgroupVersionCached(t *testing.T) {
+	assert := assert.New(t)
+
+	orgCgroupMountPoint := cgroupMountPoint
+	defer func() {
+		cgroupMountPoint = orgCgroupMountPoint
+		cgroupVersionOnce = sync.Once{}
+	}()
+
+	cgroupVersionOnce = sync.Once{}
+	cgroupMountPoint = "/does/not/exist"
+	_, err := CgroupVersion()
+	assert.Error(err)
+
+	// The first result sticks.
+	cgroupMountPoint = orgCgroupMountPoint
+	_, err2 := CgroupVersion()
+	assert.Equal(err, err2)
+}
+
+func TestProbeFSTypeAt(t *testing.T) {
+	assert := assert.New(t)
+
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	loop, cleanup := setupLoopDevice(t, 8<<20)
+	defer cleanup()
+
+	// Leave room for a partition table.
+	const offset = 1 << 20
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-E", "offset=1048576", loop, "4M").CombinedOutput()
+	if !assert.NoError(err, string(out)) {
+		return
+	}
+
+	fstype, err := ProbeFSTypeAt(loop, offset)
+	assert.NoError(err)
+	assert.Equal("ext4", fstype)
+
+	_, err = ProbeFSTypeAt(loop, 0)
+	assert.Error(err)
+
+	for _, offset := range []int64{-1, 8 << 20, 16 << 20} {
+		_, err = ProbeFSTypeAt(loop, offset)
+		assert.Error(err, "offset %d", offset)
+	}
+
+	_, err = ProbeFSTypeAt(loop+"-does-not-exist", offset)
+	assert.Error(err)
+}
+
+func TestSetFilesystemLabel(t *testing.T) {
+	assert := assert.New(t)
+
+	var gotName string
+	var gotArgs []string
+	orgRunCommand := runCommand
+	defer func() {
+		runCommand = orgRunCommand
+	}()
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		gotName = name
+		gotArgs = args
+		return nil, nil
+	}
+
+	tests := []struct {
+		fstype string
+		label  string
+		name   string
+		args   []string
+	}{
+		{"ext4", "scratch", "e2label", []string{"/dev/vdb", "scratch"}},
+		{"ext2", "0123456789abcdef", "e2label", []string{"/dev/vdb", "0123456789abcdef"}},
+		{"xfs", "scratch", "xfs_admin", []string{"-L", "scratch", "/dev/vdb"}},
+		{"vfat", "SCRATCH", "fatlabel", []string{"/dev/vdb", "SCRATCH"}},
+	}
+
+	for _, test := range tests {
+		err := SetFilesystemLabel("/dev/vdb", test.fstype, test.label)
+		assert.NoError(err, test.fstype)
+		assert.Equal(test.name, gotName, test.fstype)
+		assert.Equal(test.args, gotArgs, test.fstype)
+	}
+
+	// Spaces are escaped by udev in the names of the links.
+	byLabel := `/dev/disk/by-label/EFI\x20System`
+	assert.NoError(SetFilesystemLabel(byLabel, "vfat", "ESP"))
+	assert.Equal([]string{byLabel, "ESP"}, gotArgs)
+
+	gotName = ""
+	assert.Error(SetFilesystemLabel("", "ext4", "scratch"))
+	assert.Error(SetFilesystemLabel("/dev/vdb", "", "scratch"))
+	assert.Error(SetFilesystemLabel("/dev/vdb", "squashfs", "scratch"))
+	assert.Error(SetFilesystemLabel("/dev/vdb", "ext4", "0123456789abcdefg"))
+	assert.Error(SetFilesystemLabel("/dev/vdb", "xfs", "0123456789abc"))
+	assert.Error(SetFilesystemLabel("/dev/vdb", "vfat", "0123456789ab"))
+	assert.Empty(gotName)
+
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return []byte("Permission denied"), errors.New("exit status 1")
+	}
+	err := SetFilesystemLabel("/dev/vdb", "ext4", "scratch")
+	assert.Error(err)
+	assert.Contains(err.Error(), "Permission denied")
+
+	// Malicious values never reach the tool.
+	gotName = ""
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		gotName = name
+		return nil, nil
+	}
+	for _, test := range []struct{ disk, label string }{
+		{"/dev/vdb", "--help"},
+		{"/dev/vdb", "-f"},
+		{"/dev/vdb", "a;reboot"},
+		{"-L", "scratch"},
+		{"/dev/vdb$(id)", "scratch"},
+	} {
+		err = SetFilesystemLabel(test.disk, "ext4", test.label)
+		_, ok := err.(*ErrUnsafeArgument)
+		assert.True(ok, "%+v: %v", test, err)
+	}
+	assert.Empty(gotName)
+}
+
+func TestBlkidVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	orgRunCommand := runCommand
+	defer func() {
+		runCommand = orgRunCommand
+		blkidVersionOnce = sync.Once{}
+	}()
+
+	tests := []struct {
+		out   string
+		err   error
+		major int
+		minor int
+		valid bool
+	}{
+		{"blkid from util-linux 2.34  (libblkid 2.34.0, 14-Jun-2019)\n", nil, 2, 34, true},
+		{"blkid from util-linux 2.23.2  (libblkid 2.23.0, 25-Apr-2013)\n", nil, 2, 23, true},
+		{"blkid from util-linux-ng 2.17.2  (libblkid 2.17.0, 22-Mar-2010)\n", nil, 2, 17, true},
+		{"blkid 1.0.0 (12-Feb-2003)\n", nil, 0, 0, false},
+		{"", nil, 0, 0, false},
+		{"blkid: not found", errors.New("exit status 127"), 0, 0, false},
+	}
+
+	for _, test := range tests {
+		out, cmdErr := test.out, test.err
+		runCommand = func(name string, args ...string) ([]byte, error) {
+			assert.Equal("blkid", name)
+			assert.Equal([]string{"-V"}, args)
+			return []byte(out), cmdErr
+		}
+
+		blkidVersionOnce = sync.Once{}
+		major, minor, err := BlkidVersion()
+		if !test.valid {
+			assert.Error(err, "%q", test.out)
+			continue
+		}
+		assert.NoError(err, "%q", test.out)
+		assert.Equal(test.major, major)
+		assert.Equal(test.minor, minor)
+	}
+
+	// The version is cached.
+	blkidVersionOnce = sync.Once{}
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return []byte("blkid from util-linux 2.34  (libblkid 2.34.0, 14-Jun-2019)"), nil
+	}
+	_, _, err := BlkidVersion()
+	assert.NoError(err)
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return nil, errors.New("not called")
+	}
+	major, minor, err := BlkidVersion()
+	assert.NoError(err)
+	assert.Equal(2, major)
+	assert.Equal(34, minor)
+}
+
+func TestGrowFilesystem(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "grow")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	mountPoint, err := filepath.EvalSymlinks(dir)
+	assert.NoError(err)
+
+	orgMountInfoPath := mountInfoPath
+	orgRunCommand := runCommand
+	defer func() {
+		mountInfoPath = orgMountInfoPath
+		runCommand = orgRunCommand
+	}()
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+
+	var gotName string
+	var gotArgs []string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		gotName = name
+		gotArgs = args
+		return nil, nil
+	}
+
+	tests := []struct {
+		fstype string
+		name   string
+		args   []string
+	}{
+		{"xfs", "xfs_growfs", []string{mountPoint}},
+		{"btrfs", "btrfs", []string{"filesystem", "resize", "max", mountPoint}},
+		{"vfat", "", nil},
+	}
+
+	for _, test := range tests {
+		mountInfo := "40 22 0:35 / " + mountPoint + " rw,relatime - " + test.fstype + " /dev/vdb rw\n"
+		assert.NoError(ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644))
+
+		gotName, gotArgs = "", nil
+		err := GrowFilesystem(mountPoint)
+		if test.name == "" {
+			assert.Error(err, test.fstype)
+		} else {
+			assert.NoError(err, test.fstype)
+		}
+		assert.Equal(test.name, gotName, test.fstype)
+		assert.Equal(test.args, gotArgs, test.fstype)
+	}
+
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return []byte("Operation not permitted"), errors.New("exit status 1")
+	}
+	mountInfo := "40 22 0:35 / " + mountPoint + " rw,relatime - xfs /dev/vdb rw\n"
+	assert.NoError(ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644))
+	err = GrowFilesystem(mountPoint)
+	assert.Error(err)
+	assert.Contains(err.Error(), "Operation not permitted")
+
+	// Not a mount point
+	assert.Error(GrowFilesystem(filepath.Join(mountPoint, "mountinfo")))
+	assert.Error(GrowFilesystem("-f"))
+}
+
+func TestGrowFilesystemExt(t *testing.T) {
+	assert := assert.New(t)
+
+	loop, mountPoint, cleanup := setupMountedLoopDevice(t, 16<<20, "ext4")
+	defer cleanup()
+
+	orgRunCommand := runCommand
+	defer func() {
+		runCommand = orgRunCommand
+	}()
+
+	var gotName string
+	var gotArgs []string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		gotName = name
+		gotArgs = args
+		return nil, nil
+	}
+
+	assert.NoError(GrowFilesystem(mountPoint))
+	assert.Equal("resize2fs", gotName)
+	assert.Equal([]string{loop}, gotArgs)
+
+	// Shrink the device under the filesystem.
+	backingFile, err := readSysfsString(filepath.Join(sysfsRoot, "block", filepath.Base(loop), "loop", "backing_file"))
+	assert.NoError(err)
+	assert.NoError(os.Truncate(backingFile, 8<<20))
+	if out, err := exec.Command("losetup", "-c", loop).CombinedOutput(); err != nil {
+		t.Skipf("Could not resize %s: %v: %s", loop, err, out)
+	}
+
+	gotName = ""
+	err = GrowFilesystem(mountPoint)
+	assert.Error(err)
+	assert.Contains(err.Error(), "shrink")
+	assert.Empty(gotName)
+}
+
+func TestRecommendedMountOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		fstype   string
+		expected []string
+	}{
+		{"ext2", []string{"errors=remount-ro"}},
+		{"ext3", []string{"errors=remount-ro"}},
+		{"ext4", []string{"errors=remount-ro"}},
+		{"xfs", []string{"nouuid"}},
+		{"iso9660", []string{"ro"}},
+		{"udf", []string{"ro"}},
+		{"btrfs", nil},
+		{"tmpfs", nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.expected, RecommendedMountOptions(test.fstype), test.fstype)
+	}
+
+	// Callers can modify the returned options.
+	options := RecommendedMountOptions("xfs")
+	options[0] = "ro"
+	assert.Equal([]string{"nouuid"}, RecommendedMountOptions("xfs"))
+}
+
+func TestDeviceLabel(t *testing.T) {
+	assert := assert.New(t)
+
+	orgRunCommand := runCommand
+	defer func() {
+		runCommand = orgRunCommand
+	}()
+
+	_, err := DeviceLabel("/does/not/exist")
+	assert.Error(err)
+
+	image := writeTestImage(t, 0, &testExtSuperblock{extStateValid, 0})
+	defer os.Remove(image)
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	assert.NoError(err)
+	_, err = f.WriteAt([]byte("scratch"), extSuperblockOffset+extLabelOffset)
+	assert.NoError(err)
+	f.Close()
+
+	// blkid
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		assert.Equal("blkid", name)
+		assert.Equal(image, args[len(args)-1])
+		return []byte("probed\n"), nil
+	}
+	label, err := DeviceLabel(image)
+	assert.NoError(err)
+	assert.Equal("probed", label)
+
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return []byte("blkid: error"), errors.New("exit status 4")
+	}
+	_, err = DeviceLabel(image)
+	assert.Error(err)
+
+	// Superblock, without blkid
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return nil, &exec.Error{Name: name, Err: exec.ErrNotFound}
+	}
+	label, err = DeviceLabel(image)
+	assert.NoError(err)
+	assert.Equal("scratch", label)
+
+	empty := writeTestImage(t, 0, nil)
+	defer os.Remove(empty)
+	_, err = DeviceLabel(empty)
+	assert.Error(err)
+
+	// Real tools
+	runCommand = orgRunCommand
+	for _, tool := range []string{"blkid", "mkfs.ext4"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	for _, expected := range []string{"rootfs", ""} {
+		args := []string{"-q", "-F"}
+		if expected != "" {
+			args = append(args, "-L", expected)
+		}
+		out, err := exec.Command("mkfs.ext4", append(args, image)...).CombinedOutput()
+		assert.NoError(err, "%s", out)
+
+		label, err := DeviceLabel(image)
+		assert.NoError(err)
+		assert.Equal(expected, label)
+	}
+}
+
+func TestFilesystemSupported(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "filesystems")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	orgProcFilesystemsPath := procFilesystemsPath
+	orgKernelModulesDir := kernelModulesDir
+	orgRunningKernelRelease := runningKernelRelease
+	defer func() {
+		procFilesystemsPath = orgProcFilesystemsPath
+		kernelModulesDir = orgKernelModulesDir
+		runningKernelRelease = orgRunningKernelRelease
+	}()
+
+	const release = "5.15.0-91-generic"
+	runningKernelRelease = func() (string, error) {
+		return release, nil
+	}
+
+	procFilesystemsPath = filepath.Join(dir, "filesystems")
+	kernelModulesDir = filepath.Join(dir, "modules")
+
+	procFilesystems := "nodev\tsysfs\nnodev\ttmpfs\n\text4\n\tvfat\nnodev\toverlay\n"
+	err = ioutil.WriteFile(procFilesystemsPath, []byte(procFilesystems), 0644)
+	assert.NoError(err)
+
+	// No modules installed.
+	ok, err := FilesystemSupported("btrfs")
+	assert.NoError(err)
+	assert.False(ok)
+
+	modulesAlias := "alias fs-btrfs btrfs\nalias fs-xfs xfs\nalias devname:btrfs-control btrfs\n"
+	err = os.MkdirAll(filepath.Join(kernelModulesDir, release), 0755)
+	assert.NoError(err)
+	err = ioutil.WriteFile(filepath.Join(kernelModulesDir, release, "modules.alias"), []byte(modulesAlias), 0644)
+	assert.NoError(err)
+
+	tests := []struct {
+		fstype   string
+		expected bool
+	}{
+		{"ext4", true},
+		{"vfat", true},
+		{"tmpfs", true},
+		{"overlay", true},
+		{"btrfs", true},
+		{"xfs", true},
+		{"nodev", false},
+		{"zfs", false},
+		{"btrfs-control", false},
+	}
+
+	for _, test := range tests {
+		ok, err := FilesystemSupported(test.fstype)
+		assert.NoError(err, test.fstype)
+		assert.Equal(test.expected, ok, test.fstype)
+	}
+
+	_, err = FilesystemSupported("")
+	assert.Error(err)
+
+	// Modules of another kernel are not used.
+	runningKernelRelease = func() (string, error) {
+		return "6.1.0-13-amd64", nil
+	}
+	ok, err = FilesystemSupported("btrfs")
+	assert.NoError(err)
+	assert.False(ok)
+
+	// Registered filesystems do not need the release.
+	runningKernelRelease = func() (string, error) {
+		return "", errors.New("uname")
+	}
+	ok, err = FilesystemSupported("ext4")
+	assert.NoError(err)
+	assert.True(ok)
+
+	_, err = FilesystemSupported("btrfs")
+	assert.Error(err)
+
+	procFilesystemsPath = filepath.Join(dir, "does-not-exist")
+	_, err = FilesystemSupported("ext4")
+	assert.Error(err)
+}
+
+func TestImageFileUsage(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "image")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	// 64MiB sparse image with 4KiB of data
+	err = f.Truncate(64 << 20)
+	assert.NoError(err)
+	_, err = f.WriteAt(make([]byte, 4096), 1<<20)
+	assert.NoError(err)
+	f.Close()
+
+	apparent, actual, err := ImageFileUsage(f.Name())
+	assert.NoError(err)
+	assert.Equal(int64(64<<20), apparent)
+	assert.True(actual < apparent, "actual %d", actual)
+
+	_, _, err = ImageFileUsage("/does/not/exist")
+	assert.Error(err)
+}
+
+func TestOverlayFeatures(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	_, err := OverlayFeatures()
+	assert.Error(err)
+
+	sysfs.writeAttrs(filepath.Join(sysfs.root, "module", "overlay", "parameters"), map[string]string{
+		"check_copy_up":          "N",
+		"index":                  "N",
+		"metacopy":               "N",
+		"nfs_export":             "N",
+		"redirect_always_follow": "Y",
+		"redirect_dir":           "Y",
+		"redirect_max":           "256",
+		"xino_auto":              "N",
+	})
+
+	features, err := OverlayFeatures()
+	assert.NoError(err)
+	assert.False(features["metacopy"])
+	assert.True(features["redirect_dir"])
+	assert.False(features["index"])
+	_, ok := features["redirect_max"]
+	assert.False(ok)
+}
+
+func TestOverlaySupported(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "filesystems")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	orgProcFilesystemsPath := procFilesystemsPath
+	orgKernelModulesDir := kernelModulesDir
+	orgRunningKernelRelease := runningKernelRelease
+	defer func() {
+		procFilesystemsPath = orgProcFilesystemsPath
+		kernelModulesDir = orgKernelModulesDir
+		runningKernelRelease = orgRunningKernelRelease
+	}()
+
+	const release = "5.15.0-91-generic"
+	runningKernelRelease = func() (string, error) {
+		return release, nil
+	}
+	procFilesystemsPath = filepath.Join(dir, "filesystems")
+	kernelModulesDir = dir
+
+	err = ioutil.WriteFile(procFilesystemsPath, []byte("nodev\ttmpfs\n"), 0644)
+	assert.NoError(err)
+
+	ok, err := OverlaySupported()
+	assert.NoError(err)
+	assert.False(ok)
+
+	err = ioutil.WriteFile(procFilesystemsPath, []byte("nodev\ttmpfs\nnodev\toverlay\n"), 0644)
+	assert.NoError(err)
+
+	ok, err = OverlaySupported()
+	assert.NoError(err)
+	assert.True(ok)
+}
+
+func TestSameFilesystem(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "samefs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	err = ioutil.WriteFile(a, nil, 0644)
+	assert.NoError(err)
+
+	same, err := SameFilesystem(a, dir)
+	assert.NoError(err)
+	assert.True(same)
+
+	// procfs is never the filesystem of a temporary directory.
+	same, err = SameFilesystem(dir, "/proc/self")
+	assert.NoError(err)
+	assert.False(same)
+
+	missing := filepath.Join(dir, "missing")
+	_, err = SameFilesystem(missing, a)
+	assert.Error(err)
+	assert.True(os.IsNotExist(err))
+	assert.Equal(1, strings.Count(err.Error(), missing))
+
+	_, err = SameFilesystem(a, missing)
+	assert.Error(err)
+	assert.True(os.IsNotExist(err))
+	assert.Equal(1, strings.Count(err.Error(), missing))
+}
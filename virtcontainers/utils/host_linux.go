@@ -0,0 +1,157 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// HostVirtBareMetal means the host is not a virtual machine.
+	HostVirtBareMetal = "bare-metal"
+
+	// HostVirtUnknown means the host virtualization could not be
+	// detected, or that the host is a virtual machine of an unknown type.
+	HostVirtUnknown = "unknown"
+)
+
+// procCPUInfoPath describes the processors of the host.
+var procCPUInfoPath = "/proc/cpuinfo"
+
+// dmiVendors maps the DMI vendor or product strings of virtual machines to
+// their virtualization type, in detection order.
+var dmiVendors = []struct {
+	prefix   string
+	virtType string
+}{
+	{"KVM", "kvm"},
+	{"Amazon EC2", "amazon"},
+	{"QEMU", "qemu"},
+	{"VMware", "vmware"},
+	{"VMW", "vmware"},
+	{"innotek GmbH", "oracle"},
+	{"VirtualBox", "oracle"},
+	{"Xen", "xen"},
+	{"Bochs", "bochs"},
+	{"Parallels", "parallels"},
+	{"BHYVE", "bhyve"},
+	{"Google Compute Engine", "google"},
+	{"Microsoft Corporation Virtual Machine", "microsoft"},
+}
+
+// HostVirtType returns the type of virtual machine the host is, e.g. "kvm",
+// "qemu" or "vmware", HostVirtBareMetal if it is not a virtual machine, or
+// HostVirtUnknown. Like systemd-detect-virt, it relies on the Xen
+// hypervisor type, the DMI strings and the CPU hypervisor flag. Detection
+// is best effort and does not fail, the error is always nil.
+func HostVirtType() (string, error) {
+	if t, _ := readSysfsString(filepath.Join(sysfsRoot, "hypervisor", "type")); t == "xen" {
+		return "xen", nil
+	}
+
+	dmiRead := false
+	dmiDir := filepath.Join(sysfsRoot, "class", "dmi", "id")
+	for _, f := range [][]string{{"sys_vendor"}, {"product_name"}, {"board_vendor"}, {"bios_vendor"}, {"sys_vendor", "product_name"}} {
+		var values []string
+		for _, name := range f {
+			v, err := readSysfsString(filepath.Join(dmiDir, name))
+			if err != nil {
+				break
+			}
+			values = append(values, v)
+		}
+
+		if len(values) != len(f) {
+			continue
+		}
+		dmiRead = true
+
+		value := strings.Join(values, " ")
+		for _, v := range dmiVendors {
+			if strings.HasPrefix(value, v.prefix) {
+				return v.virtType, nil
+			}
+		}
+	}
+
+	if cpuHypervisorFlag() {
+		return HostVirtUnknown, nil
+	}
+
+	if dmiRead {
+		return HostVirtBareMetal, nil
+	}
+
+	return HostVirtUnknown, nil
+}
+
+// cpuHypervisorFlag returns true if the processors report running on a
+// hypervisor.
+func cpuHypervisorFlag() bool {
+	f, err := os.Open(procCPUInfoPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) != "flags" {
+			continue
+		}
+
+		for _, flag := range strings.Fields(fields[1]) {
+			if flag == "hypervisor" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return false
+}
+
+// kataSharedTag is the tag of the shared filesystem the Kata agent mounts
+// in the guest, as 9p or virtio-fs.
+const kataSharedTag = "kataShared"
+
+// kataGuestSandboxDir is created by the Kata agent in the guest, next to
+// /run/kata-containers/shared, the only directory also found on the host.
+var kataGuestSandboxDir = "/run/kata-containers/sandbox"
+
+// IsKataGuest returns true if the current process runs inside the virtual
+// machine of a Kata sandbox. It relies on what the Kata agent sets up in
+// the guest, in this order:
+//   - a mount of the kataShared 9p or virtio-fs tag, the shared filesystem
+//     holding the container root filesystems.
+//   - the /run/kata-containers/sandbox directory, where the agent keeps the
+//     sandbox storage, e.g. when the shared filesystem is disabled.
+//
+// Detection is best effort: false without an error means no marker was
+// found, an error means the mounts could not be read.
+func IsKataGuest() (bool, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range mounts {
+		if m.Source == kataSharedTag {
+			return true, nil
+		}
+	}
+
+	if fi, err := os.Stat(kataGuestSandboxDir); err == nil && fi.IsDir() {
+		return true, nil
+	}
+
+	return false, nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostVirtType(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "virt")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	orgProcCPUInfoPath := procCPUInfoPath
+	defer func() {
+		procCPUInfoPath = orgProcCPUInfoPath
+	}()
+	procCPUInfoPath = filepath.Join(dir, "cpuinfo")
+
+	tests := []struct {
+		dmi      map[string]string
+		xen      bool
+		cpuFlag  bool
+		expected string
+	}{
+		{nil, false, false, HostVirtUnknown},
+		{nil, false, true, HostVirtUnknown},
+		{nil, true, false, "xen"},
+		{map[string]string{"sys_vendor": "QEMU", "product_name": "Standard PC (Q35 + ICH9, 2009)"}, false, true, "qemu"},
+		{map[string]string{"sys_vendor": "Red Hat", "product_name": "KVM"}, false, true, "kvm"},
+		{map[string]string{"sys_vendor": "VMware, Inc.", "product_name": "VMware Virtual Platform"}, false, true, "vmware"},
+		{map[string]string{"sys_vendor": "innotek GmbH", "product_name": "VirtualBox"}, false, true, "oracle"},
+		{map[string]string{"sys_vendor": "Amazon EC2", "product_name": "m5.large"}, false, true, "amazon"},
+		{map[string]string{"sys_vendor": "Microsoft Corporation", "product_name": "Virtual Machine"}, false, true, "microsoft"},
+		{map[string]string{"sys_vendor": "Google", "product_name": "Google Compute Engine"}, false, true, "google"},
+		{map[string]string{"sys_vendor": "Dell Inc.", "product_name": "PowerEdge R640"}, false, false, HostVirtBareMetal},
+		{map[string]string{"sys_vendor": "Dell Inc.", "product_name": "PowerEdge R640"}, false, true, HostVirtUnknown},
+	}
+
+	for i, test := range tests {
+		sysfs, cleanup := newTestSysfs(t)
+
+		if test.dmi != nil {
+			sysfs.writeAttrs(filepath.Join(sysfs.root, "class", "dmi", "id"), test.dmi)
+		}
+
+		if test.xen {
+			sysfs.writeAttrs(filepath.Join(sysfs.root, "hypervisor"), map[string]string{"type": "xen"})
+		}
+
+		flags := "fpu vme de pse tsc msr"
+		if test.cpuFlag {
+			flags += " hypervisor"
+		}
+		cpuinfo := "processor\t: 0\nvendor_id\t: GenuineIntel\nflags\t\t: " + flags + "\n\n"
+		err := ioutil.WriteFile(procCPUInfoPath, []byte(cpuinfo), 0644)
+		assert.NoError(err)
+
+		virtType, err := HostVirtType()
+		assert.NoError(err, "test %d", i)
+		assert.Equal(test.expected, virtType, "test %d", i)
+
+		cleanup()
+	}
+
+	// Nothing readable
+	procCPUInfoPath = filepath.Join(dir, "does-not-exist")
+	_, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	virtType, err := HostVirtType()
+	assert.NoError(err)
+	assert.Equal(HostVirtUnknown, virtType)
+}
+
+func TestIsKataGuest(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kata")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	orgMountInfoPath := mountInfoPath
+	orgKataGuestSandboxDir := kataGuestSandboxDir
+	defer func() {
+		mountInfoPath = orgMountInfoPath
+		kataGuestSandboxDir = orgKataGuestSandboxDir
+	}()
+	mountInfoPath = filepath.Join(dir, "mountinfo")
+	kataGuestSandboxDir = filepath.Join(dir, "sandbox")
+
+	const rootMount = "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"
+
+	tests := []struct {
+		mountInfo  string
+		sandboxDir bool
+		expected   bool
+	}{
+		{rootMount, false, false},
+		{rootMount + "40 22 0:35 / /run/kata-containers/shared/containers rw,relatime - 9p kataShared rw,trans=virtio\n", false, true},
+		{rootMount + "40 22 0:35 / /run/kata-containers/shared/containers rw,relatime - virtiofs kataShared rw\n", false, true},
+		// Another 9p share
+		{rootMount + "40 22 0:35 / /mnt rw,relatime - 9p share rw,trans=virtio\n", false, false},
+		{rootMount, true, true},
+	}
+
+	for i, test := range tests {
+		assert.NoError(ioutil.WriteFile(mountInfoPath, []byte(test.mountInfo), 0644))
+		if test.sandboxDir {
+			assert.NoError(os.Mkdir(kataGuestSandboxDir, 0755))
+		}
+
+		guest, err := IsKataGuest()
+		assert.NoError(err, "test %d", i)
+		assert.Equal(test.expected, guest, "test %d", i)
+
+		os.RemoveAll(kataGuestSandboxDir)
+	}
+
+	// A file is not a marker
+	assert.NoError(ioutil.WriteFile(kataGuestSandboxDir, nil, 0644))
+	guest, err := IsKataGuest()
+	assert.NoError(err)
+	assert.False(guest)
+
+	os.Remove(mountInfoPath)
+	_, err = IsKataGuest()
+	assert.Error(err)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelVersionRegex matches the version at the start of a kernel release,
+// whatever the distribution suffix, e.g. "4.18.0-477.el8.x86_64".
+var kernelVersionRegex = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+// runningKernelRelease returns the release of the running kernel.
+// It is a variable so tests can replace it.
+var runningKernelRelease = kernelRelease
+
+// msNoSymFollow is MS_NOSYMFOLLOW, which refuses to follow symbolic links
+// on the mount.
+const msNoSymFollow = 0x100
+
+// mountFlagVersions are the kernel versions that introduced the optional
+// mount flags, see MountFlagSupported.
+var mountFlagVersions = map[uintptr]struct {
+	major, minor int
+}{
+	unix.MS_LAZYTIME: {4, 0},
+	msNoSymFollow:    {5, 10},
+}
+
+// parseKernelRelease returns the major and minor versions of the kernel
+// release, as uname -r prints it.
+func parseKernelRelease(release string) (int, int, error) {
+	m := kernelVersionRegex.FindStringSubmatch(release)
+	if m == nil {
+		return 0, 0, fmt.Errorf("Invalid kernel release %q", release)
+	}
+
+	major, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid kernel release %q: %v", release, err)
+	}
+
+	minor, err := strconv.Atoi(m[2])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid kernel release %q: %v", release, err)
+	}
+
+	return major, minor, nil
+}
+
+// KernelVersionAtLeast returns true if the running kernel is at least
+// version major.minor. Distributions backport features to older versions,
+// probing a feature is more accurate when it can be done safely.
+func KernelVersionAtLeast(major, minor int) (bool, error) {
+	release, err := runningKernelRelease()
+	if err != nil {
+		return false, err
+	}
+
+	kernelMajor, kernelMinor, err := parseKernelRelease(release)
+	if err != nil {
+		return false, err
+	}
+
+	return kernelMajor > major || (kernelMajor == major && kernelMinor >= minor), nil
+}
+
+// MountFlagSupported returns true if the running kernel supports the
+// optional mount flag, e.g. MS_LAZYTIME or MS_NOSYMFOLLOW, which older
+// kernels reject, so that callers only opt into them where supported. Only
+// the flags introduced in 4.0 or later are known, the others are an error.
+func MountFlagSupported(flag uintptr) (bool, error) {
+	v, ok := mountFlagVersions[flag]
+	if !ok {
+		return false, fmt.Errorf("Unknown optional mount flag %#x", flag)
+	}
+
+	return KernelVersionAtLeast(v.major, v.minor)
+}
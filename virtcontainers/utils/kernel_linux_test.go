@@ -0,0 +1,99 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseKernelRelease(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		release      string
+		major, minor int
+	}{
+		{"5.15.0-91-generic", 5, 15},
+		{"4.18.0-477.el8.x86_64", 4, 18},
+		{"2.6.32-754.el6.i686", 2, 6},
+		{"6.1.0+", 6, 1},
+		{"5.10", 5, 10},
+		{"5.4.0-1103-aws", 5, 4},
+		{"6.6.12-coreos", 6, 6},
+	}
+
+	for _, test := range tests {
+		major, minor, err := parseKernelRelease(test.release)
+		assert.NoError(err, test.release)
+		assert.Equal(test.major, major, test.release)
+		assert.Equal(test.minor, minor, test.release)
+	}
+
+	for _, release := range []string{"", "5", "linux-5.10", "v5.10", "5.x"} {
+		_, _, err := parseKernelRelease(release)
+		assert.Error(err, release)
+	}
+}
+
+func TestKernelVersionAtLeast(t *testing.T) {
+	assert := assert.New(t)
+
+	orgRunningKernelRelease := runningKernelRelease
+	defer func() {
+		runningKernelRelease = orgRunningKernelRelease
+	}()
+
+	// The real kernel
+	ok, err := KernelVersionAtLeast(2, 6)
+	assert.NoError(err)
+	assert.True(ok)
+
+	runningKernelRelease = func() (string, error) {
+		return "4.18.0-477.el8.x86_64", nil
+	}
+
+	for _, test := range []struct {
+		major, minor int
+		expected     bool
+	}{
+		{3, 10, true},
+		{4, 0, true},
+		{4, 18, true},
+		{4, 19, false},
+		{5, 0, false},
+	} {
+		ok, err := KernelVersionAtLeast(test.major, test.minor)
+		assert.NoError(err)
+		assert.Equal(test.expected, ok, "%d.%d", test.major, test.minor)
+	}
+
+	ok, err = MountFlagSupported(unix.MS_LAZYTIME)
+	assert.NoError(err)
+	assert.True(ok)
+
+	ok, err = MountFlagSupported(msNoSymFollow)
+	assert.NoError(err)
+	assert.False(ok)
+
+	_, err = MountFlagSupported(unix.MS_RDONLY)
+	assert.Error(err)
+
+	runningKernelRelease = func() (string, error) {
+		return "bogus", nil
+	}
+	_, err = KernelVersionAtLeast(4, 0)
+	assert.Error(err)
+
+	runningKernelRelease = func() (string, error) {
+		return "", errors.New("uname")
+	}
+	_, err = MountFlagSupported(unix.MS_LAZYTIME)
+	assert.Error(err)
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// deletedSuffix is appended by the kernel to the backing file of a loop
+// device when that file was removed.
+const deletedSuffix = " (deleted)"
+
+// ErrNoBackingFile is returned by LoopBackingFile when the loop device is
+// not attached to a file.
+var ErrNoBackingFile = errors.New("Loop device has no backing file")
+
+// loopBackingFile returns the path of the file backing the loop device
+// name, and whether that file was removed since it was attached.
+func loopBackingFile(name string) (string, bool, error) {
+	sysDir := filepath.Join(sysfsRoot, "block", name)
+
+	data, err := ioutil.ReadFile(filepath.Join(sysDir, "loop", "backing_file"))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(sysDir); err != nil {
+			return "", false, fmt.Errorf("Block device %s not found in sysfs: %v", name, err)
+		}
+		return "", false, ErrNoBackingFile
+	} else if err != nil {
+		return "", false, err
+	}
+
+	// Only trim the newline, file names may end with spaces.
+	backingFile := strings.TrimSuffix(string(data), "\n")
+	if backingFile == "" {
+		return "", false, ErrNoBackingFile
+	}
+
+	if strings.HasSuffix(backingFile, deletedSuffix) {
+		return strings.TrimSuffix(backingFile, deletedSuffix), true, nil
+	}
+
+	return backingFile, false, nil
+}
+
+// LoopBackingFile returns the path of the file backing the loop device
+// loopPath, e.g. /dev/loop0, as it was when the device was attached. The
+// " (deleted)" suffix the kernel appends when the file was removed is
+// trimmed, see FindStaleLoopDevices to detect those. ErrNoBackingFile is
+// returned if the loop device is not attached.
+func LoopBackingFile(loopPath string) (string, error) {
+	name, err := blockDeviceName(loopPath)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasPrefix(name, "loop") {
+		return "", fmt.Errorf("%v is not a loop device", loopPath)
+	}
+
+	backingFile, _, err := loopBackingFile(name)
+	return backingFile, err
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoopBackingFile(t *testing.T) {
+	assert := assert.New(t)
+
+	s, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	loop0 := s.addDisk("loop0", nil)
+	loop1 := s.addDisk("loop1", map[string]string{"loop/backing_file": "/var/lib/images/disk.img"})
+	loop2 := s.addDisk("loop2", map[string]string{"loop/backing_file": "/var/lib/images/gone.img" + deletedSuffix})
+	loop3 := s.addDisk("loop3", map[string]string{"loop/backing_file": "/var/lib/images/trailing "})
+	sda := s.addDisk("sda", nil)
+
+	_, err := LoopBackingFile(loop0)
+	assert.Equal(ErrNoBackingFile, err)
+
+	backingFile, err := LoopBackingFile(loop1)
+	assert.NoError(err)
+	assert.Equal("/var/lib/images/disk.img", backingFile)
+
+	backingFile, err = LoopBackingFile(loop2)
+	assert.NoError(err)
+	assert.Equal("/var/lib/images/gone.img", backingFile)
+
+	backingFile, deleted, err := loopBackingFile("loop2")
+	assert.NoError(err)
+	assert.True(deleted)
+	assert.Equal("/var/lib/images/gone.img", backingFile)
+
+	backingFile, err = LoopBackingFile(loop3)
+	assert.NoError(err)
+	assert.Equal("/var/lib/images/trailing ", backingFile)
+
+	_, err = LoopBackingFile(sda)
+	assert.Error(err)
+	assert.NotEqual(ErrNoBackingFile, err)
+
+	_, err = LoopBackingFile("")
+	assert.Error(err)
+
+	_, err = LoopBackingFile("/does/not/exist")
+	assert.Error(err)
+
+	loop9 := filepath.Join(s.dev, "loop9")
+	f, err := os.Create(loop9)
+	assert.NoError(err)
+	f.Close()
+	_, err = LoopBackingFile(loop9)
+	assert.Error(err)
+	assert.NotEqual(ErrNoBackingFile, err)
+}
+
+func TestLoopBackingFileDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	loop, cleanup := setupLoopDevice(t, 1<<20)
+	defer cleanup()
+
+	backingFile, err := LoopBackingFile(loop)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(filepath.Base(backingFile), "loop"), backingFile)
+
+	_, err = os.Stat(backingFile)
+	assert.NoError(err)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// hugePagesDirPrefix starts the names of the directories describing the
+// huge page pools in sysfs, e.g. "hugepages-2048kB".
+const hugePagesDirPrefix = "hugepages-"
+
+// PageSize returns the size in bytes of the memory pages.
+func PageSize() int {
+	return unix.Getpagesize()
+}
+
+// HugePagesAvailable returns how many huge pages are reserved in every pool
+// of the system, by page size, e.g. "2048kB" or "1048576kB", as reported by
+// nr_hugepages in sysfs. The pools that cannot be read are left out, and no
+// pool is returned when the kernel does not support huge pages.
+func HugePagesAvailable() (map[string]int, error) {
+	pools := make(map[string]int)
+
+	dir := filepath.Join(sysfsRoot, "kernel", "mm", "hugepages")
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return pools, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), hugePagesDirPrefix) {
+			continue
+		}
+
+		n, err := readSysfsUint(filepath.Join(dir, e.Name(), "nr_hugepages"))
+		if err != nil {
+			continue
+		}
+
+		pools[strings.TrimPrefix(e.Name(), hugePagesDirPrefix)] = int(n)
+	}
+
+	return pools, nil
+}
+
+// nodeHugePagesAttr returns the path of nr_hugepages for the pool of size
+// KiB pages of the NUMA node, which must exist.
+func nodeHugePagesAttr(node, size int) (string, error) {
+	if node < 0 {
+		return "", fmt.Errorf("Invalid NUMA node %d", node)
+	}
+
+	if size <= 0 {
+		return "", fmt.Errorf("Invalid huge page size %dkB", size)
+	}
+
+	nodeDir := filepath.Join(sysfsRoot, "devices", "system", "node", fmt.Sprintf("node%d", node))
+	if _, err := os.Stat(nodeDir); err != nil {
+		return "", fmt.Errorf("NUMA node %d not found: %v", node, err)
+	}
+
+	path := filepath.Join(nodeDir, "hugepages", fmt.Sprintf("%s%dkB", hugePagesDirPrefix, size), "nr_hugepages")
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("NUMA node %d has no %dkB huge pages pool: %v", node, size, err)
+	}
+
+	return path, nil
+}
+
+// GetNodeHugePages returns how many huge pages of size KiB, e.g. 2048, are
+// reserved on the NUMA node, see HugePagesAvailable for the whole system.
+func GetNodeHugePages(node, size int) (int, error) {
+	path, err := nodeHugePagesAttr(node, size)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := readSysfsUint(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// SetNodeHugePages asks the kernel to reserve count huge pages of size KiB
+// on the NUMA node. The kernel might reserve fewer pages when memory is
+// fragmented, GetNodeHugePages tells how many it did.
+func SetNodeHugePages(node, size, count int) error {
+	if count < 0 {
+		return fmt.Errorf("Invalid number of huge pages %d", count)
+	}
+
+	path, err := nodeHugePagesAttr(node, size)
+	if err != nil {
+		return err
+	}
+
+	return WriteToFile(path, []byte(strconv.Itoa(count)))
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageSize(t *testing.T) {
+	assert := assert.New(t)
+
+	size := PageSize()
+	assert.True(size >= 4096)
+	assert.Zero(size & (size - 1))
+}
+
+func TestHugePagesAvailable(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	// No huge pages support
+	pools, err := HugePagesAvailable()
+	assert.NoError(err)
+	assert.Empty(pools)
+
+	dir := filepath.Join(sysfs.root, "kernel", "mm", "hugepages")
+	sysfs.writeAttrs(dir, map[string]string{
+		"hugepages-2048kB/nr_hugepages":    "512",
+		"hugepages-1048576kB/nr_hugepages": "0",
+		"hugepages-64kB/nr_hugepages":      "bogus",
+	})
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "other"), 0755))
+
+	pools, err = HugePagesAvailable()
+	assert.NoError(err)
+	assert.Equal(map[string]int{"2048kB": 512, "1048576kB": 0}, pools)
+}
+
+func TestNodeHugePages(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	nodes := filepath.Join(sysfs.root, "devices", "system", "node")
+	sysfs.writeAttrs(nodes, map[string]string{
+		"node0/hugepages/hugepages-2048kB/nr_hugepages":    "128",
+		"node0/hugepages/hugepages-1048576kB/nr_hugepages": "2",
+		"node1/hugepages/hugepages-2048kB/nr_hugepages":    "0",
+	})
+	assert.NoError(os.MkdirAll(filepath.Join(nodes, "node2"), 0755))
+
+	n, err := GetNodeHugePages(0, 2048)
+	assert.NoError(err)
+	assert.Equal(128, n)
+
+	n, err = GetNodeHugePages(0, 1048576)
+	assert.NoError(err)
+	assert.Equal(2, n)
+
+	n, err = GetNodeHugePages(1, 2048)
+	assert.NoError(err)
+	assert.Equal(0, n)
+
+	assert.NoError(SetNodeHugePages(1, 2048, 256))
+	n, err = GetNodeHugePages(1, 2048)
+	assert.NoError(err)
+	assert.Equal(256, n)
+
+	for _, test := range []struct {
+		node, size int
+	}{
+		{-1, 2048},
+		{0, 0},
+		{0, -2048},
+		{0, 64},
+		{2, 2048},
+		{3, 2048},
+	} {
+		_, err := GetNodeHugePages(test.node, test.size)
+		assert.Error(err, "%+v", test)
+		assert.Error(SetNodeHugePages(test.node, test.size, 1), "%+v", test)
+	}
+
+	assert.Error(SetNodeHugePages(0, 2048, -1))
+}
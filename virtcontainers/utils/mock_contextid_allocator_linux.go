@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// MockContextIDAllocator is an in-memory ContextIDAllocator for tests. It
+// hands out the lowest free context ID, from 3, and no file.
+type MockContextIDAllocator struct {
+	// AllocateErr, when not nil, is returned by Allocate.
+	AllocateErr error
+
+	mu        sync.Mutex
+	allocated map[uint64]time.Time
+}
+
+// Allocate implements ContextIDAllocator.
+func (m *MockContextIDAllocator) Allocate() (*os.File, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.AllocateErr != nil {
+		return nil, 0, m.AllocateErr
+	}
+
+	if m.allocated == nil {
+		m.allocated = make(map[uint64]time.Time)
+	}
+
+	cid := uint64(3)
+	for {
+		if _, ok := m.allocated[cid]; !ok {
+			break
+		}
+		cid++
+	}
+	m.allocated[cid] = time.Now()
+
+	return nil, cid, nil
+}
+
+// Release implements ContextIDAllocator.
+func (m *MockContextIDAllocator) Release(cid uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.allocated[cid]; !ok {
+		return fmt.Errorf("Context ID %d was not allocated", cid)
+	}
+	delete(m.allocated, cid)
+
+	return nil
+}
+
+// Snapshot returns the context IDs currently allocated, sorted by context
+// ID.
+func (m *MockContextIDAllocator) Snapshot() []ContextIDInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	infos := make([]ContextIDInfo, 0, len(m.allocated))
+	for cid, allocated := range m.allocated {
+		infos = append(infos, ContextIDInfo{
+			ContextID: cid,
+			Allocated: allocated,
+		})
+	}
+	sortContextIDInfos(infos)
+
+	return infos
+}
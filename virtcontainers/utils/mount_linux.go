@@ -0,0 +1,553 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// BindMount bind mounts source on target, which must both exist. Mounts
+// below source are not part of the bind mount.
+// MS_RDONLY is ignored when creating a bind mount, a readonly bind mount
+// takes a second remount with the readonly flag, which BindMount does when
+// readonly is true.
+func BindMount(source, target string, readonly bool) error {
+	if source == "" {
+		return fmt.Errorf("source must be specified")
+	}
+	if target == "" {
+		return fmt.Errorf("target must be specified")
+	}
+
+	if err := unix.Mount(source, target, "bind", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("Could not bind mount %v to %v: %v", source, target, err)
+	}
+
+	if !readonly {
+		return nil
+	}
+
+	if err := unix.Mount(source, target, "bind", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		// Do not leave a writable mount behind.
+		unix.Unmount(target, unix.MNT_DETACH)
+		return fmt.Errorf("Could not remount %v readonly: %v", target, err)
+	}
+
+	return nil
+}
+
+// UnmountOptions describes how Unmount escalates when target is busy.
+type UnmountOptions struct {
+	// Force retries with MNT_FORCE, aborting pending requests. This
+	// is only supported by some filesystems, e.g. NFS or FUSE.
+	Force bool
+
+	// Lazy retries with MNT_DETACH, detaching target right away and
+	// cleaning the mount up once it is not busy anymore.
+	Lazy bool
+}
+
+// Unmount unmounts target. If target is busy, it escalates to a forced
+// and then a lazy unmount, but only if opts allows it.
+func Unmount(target string, opts UnmountOptions) error {
+	if target == "" {
+		return fmt.Errorf("target must be specified")
+	}
+
+	strategies := []struct {
+		name    string
+		flags   int
+		enabled bool
+	}{
+		{"normal", 0, true},
+		{"forced", unix.MNT_FORCE, opts.Force},
+		{"lazy", unix.MNT_DETACH, opts.Lazy},
+	}
+
+	var err error
+	var tried string
+	for _, s := range strategies {
+		if !s.enabled {
+			continue
+		}
+
+		tried = s.name
+		if err = unix.Unmount(target, s.flags); err == nil {
+			return nil
+		}
+
+		// Escalating only helps with busy mounts.
+		if err != unix.EBUSY {
+			break
+		}
+	}
+
+	return fmt.Errorf("Could not unmount %v (%s unmount): %v", target, tried, err)
+}
+
+// MountInfo describes a mount, as listed in /proc/<pid>/mountinfo.
+// See proc(5).
+type MountInfo struct {
+	// MountID is the unique ID of the mount.
+	MountID int
+
+	// ParentID is the ID of the parent mount.
+	ParentID int
+
+	// Major and Minor identify the device of the mounted filesystem,
+	// as st_dev does.
+	Major uint32
+	Minor uint32
+
+	// Root is the path of the directory of the filesystem mounted on
+	// MountPoint.
+	Root string
+
+	// MountPoint is the path of the mount point.
+	MountPoint string
+
+	// Options are the per mount options.
+	Options string
+
+	// OptionalFields are the optional "tag[:value]" fields, e.g.
+	// "shared:1".
+	OptionalFields []string
+
+	// FSType is the filesystem type, e.g. "ext4".
+	FSType string
+
+	// Source is the filesystem specific source, e.g. "/dev/sda1".
+	Source string
+
+	// SuperOptions are the per superblock options.
+	SuperOptions string
+}
+
+// mountInfoPath is the mountinfo file of the current process.
+var mountInfoPath = "/proc/self/mountinfo"
+
+// readMountInfo returns the mounts of the current process.
+func readMountInfo() ([]MountInfo, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseMountInfo(f)
+}
+
+// procMountsPath lists the mounts of the current process, with less
+// details than mountInfoPath.
+var procMountsPath = "/proc/mounts"
+
+// readMounts returns the mounts of the current process like
+// readMountInfo, falling back to procMountsPath when mountinfo cannot be
+// read, e.g. in restricted environments. The mounts read from
+// procMountsPath have no IDs, no root, no optional fields and no device
+// numbers, and their Options hold both the per mount and per superblock
+// options. The returned boolean is true when the mounts come from
+// mountinfo. IsRootDevice, DevIsDevtmpfs, IsKataGuest and
+// findStaleDevices still require mountinfo.
+func readMounts() ([]MountInfo, bool, error) {
+	mounts, err := readMountInfo()
+	if err == nil {
+		return mounts, true, nil
+	}
+
+	f, procErr := os.Open(procMountsPath)
+	if procErr != nil {
+		// The mountinfo error is the relevant one.
+		return nil, false, err
+	}
+	defer f.Close()
+
+	procMounts, err := ParseProcMounts(f)
+	if err != nil {
+		return nil, false, err
+	}
+
+	mounts = make([]MountInfo, 0, len(procMounts))
+	for _, m := range procMounts {
+		mounts = append(mounts, MountInfo{
+			MountPoint: m.MountPoint,
+			Options:    m.Options,
+			FSType:     m.FSType,
+			Source:     m.Source,
+		})
+	}
+
+	return mounts, false, nil
+}
+
+// deviceMountPoints returns where the device major:minor is mounted in the
+// mount namespace of the current process. Mounts read from /proc/mounts
+// have no device numbers, so their source is looked up instead, which
+// misses devices mounted through a node that does not exist in /dev, e.g.
+// /dev/root.
+func deviceMountPoints(major, minor uint32) ([]string, error) {
+	mounts, detailed, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	var mountPoints []string
+	for _, m := range mounts {
+		if !detailed {
+			var st unix.Stat_t
+			if err := unix.Stat(m.Source, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFBLK {
+				// Not a device, e.g. tmpfs or overlay.
+				continue
+			}
+			m.Major = unix.Major(uint64(st.Rdev))
+			m.Minor = unix.Minor(uint64(st.Rdev))
+		}
+
+		if m.Major == major && m.Minor == minor {
+			mountPoints = append(mountPoints, m.MountPoint)
+		}
+	}
+
+	return mountPoints, nil
+}
+
+// findMount returns the mount whose mount point is mountPoint, the top
+// most one if several filesystems are mounted there.
+func findMount(mountPoint string) (*MountInfo, error) {
+	path, err := filepath.EvalSymlinks(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, detailed, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == path {
+			found = &mounts[i]
+		}
+	}
+
+	if found == nil {
+		return nil, fmt.Errorf("%v is not a mount point", mountPoint)
+	}
+
+	// Mounts read from /proc/mounts have no device numbers, but the top
+	// most mount is the one whose device the mount point is on.
+	if !detailed {
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+		}
+		found.Major = unix.Major(uint64(st.Dev))
+		found.Minor = unix.Minor(uint64(st.Dev))
+	}
+
+	return found, nil
+}
+
+// WaitForMount waits about every interval for a filesystem to be mounted on
+// mountPoint, which does not need to exist yet, e.g. when it is mounted
+// asynchronously or by an automounter, until it is or ctx is done. It
+// returns right away if a filesystem is already mounted there.
+func WaitForMount(ctx context.Context, mountPoint string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid interval %v", interval)
+	}
+
+	err := RetryWithBackoff(ctx, interval, interval, func() (bool, error) {
+		path, err := filepath.EvalSymlinks(mountPoint)
+		if os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		mounts, _, err := readMounts()
+		if err != nil {
+			return false, err
+		}
+
+		for _, m := range mounts {
+			if m.MountPoint == path {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+
+	if err != nil && err == ctx.Err() {
+		return fmt.Errorf("Nothing mounted on %v yet: %v", mountPoint, err)
+	}
+
+	return err
+}
+
+// DeviceForMount returns the path of the block device mounted on
+// mountPoint, it fails if the filesystem is not backed by a block device.
+func DeviceForMount(mountPoint string) (string, error) {
+	m, err := findMount(mountPoint)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := DevicePathFromNumbers(m.Major, m.Minor)
+	if err != nil {
+		return "", fmt.Errorf("Could not find the device of %s filesystem mounted on %v: %v", m.FSType, mountPoint, err)
+	}
+
+	return path, nil
+}
+
+// MountedFilesystemUUID returns the UUID of the filesystem mounted on
+// mountPoint, read from its superblock. Only ext2/3/4 and XFS filesystems
+// are supported.
+func MountedFilesystemUUID(mountPoint string) (string, error) {
+	disk, err := DeviceForMount(mountPoint)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(disk)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	uuid, err := readFilesystemUUID(f, 0)
+	if err != nil {
+		return "", fmt.Errorf("Could not read the UUID of %v: %v", disk, err)
+	}
+
+	return uuid, nil
+}
+
+// MountIsReadOnly returns true if the filesystem mounted on mountPoint is
+// currently read-only, either because of the mount itself, e.g. a read-only
+// bind mount, or because its superblock is, whatever the device can do.
+func MountIsReadOnly(mountPoint string) (bool, error) {
+	m, err := findMount(mountPoint)
+	if err != nil {
+		return false, err
+	}
+
+	return hasMountOption(m.Options, "ro") || hasMountOption(m.SuperOptions, "ro"), nil
+}
+
+// hasMountOption returns true if option is one of the comma separated
+// options.
+func hasMountOption(options, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseMountInfo parses mountinfo formatted content, as found in
+// /proc/<pid>/mountinfo.
+func ParseMountInfo(reader io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		m, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		mounts = append(mounts, m)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// Mount describes a mount, as listed in /proc/mounts. See fstab(5).
+type Mount struct {
+	// Source is the filesystem specific source, e.g. "/dev/sda1".
+	Source string
+
+	// MountPoint is the path of the mount point.
+	MountPoint string
+
+	// FSType is the filesystem type, e.g. "ext4".
+	FSType string
+
+	// Options are the mount options, per mount and per superblock.
+	Options string
+
+	// Freq and PassNo are always 0 for the mounts listed by the kernel.
+	Freq   int
+	PassNo int
+}
+
+// ParseProcMounts parses /proc/mounts formatted content, e.g. when
+// /proc/self/mountinfo cannot be read. Unlike ParseMountInfo, it does not
+// tell the mount IDs, the device numbers, which directory of the filesystem
+// is mounted, or the propagation of the mounts.
+func ParseProcMounts(reader io.Reader) ([]Mount, error) {
+	var mounts []Mount
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, " ")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("Invalid mounts line: %q", line)
+		}
+
+		m := Mount{
+			Source:     UnescapeOctalPath(fields[0]),
+			MountPoint: UnescapeOctalPath(fields[1]),
+			FSType:     fields[2],
+			Options:    fields[3],
+		}
+
+		var err error
+		if m.Freq, err = strconv.Atoi(fields[4]); err != nil {
+			return nil, fmt.Errorf("Invalid dump frequency in mounts line %q: %v", line, err)
+		}
+
+		if m.PassNo, err = strconv.Atoi(fields[5]); err != nil {
+			return nil, fmt.Errorf("Invalid pass number in mounts line %q: %v", line, err)
+		}
+
+		mounts = append(mounts, m)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// parseMountInfoLine parses a mountinfo line, e.g.
+// "36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw,errors=continue"
+// Paths do not contain spaces since the kernel escapes them, see
+// UnescapeOctalPath.
+func parseMountInfoLine(line string) (MountInfo, error) {
+	var m MountInfo
+
+	fields := strings.Split(line, " ")
+
+	// The optional fields are terminated by a single "-".
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+
+	if sep < 0 || len(fields) != sep+4 {
+		return m, fmt.Errorf("Invalid mountinfo line: %q", line)
+	}
+
+	var err error
+	if m.MountID, err = strconv.Atoi(fields[0]); err != nil {
+		return m, fmt.Errorf("Invalid mount ID in mountinfo line %q: %v", line, err)
+	}
+
+	if m.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return m, fmt.Errorf("Invalid parent ID in mountinfo line %q: %v", line, err)
+	}
+
+	dev := strings.Split(fields[2], ":")
+	if len(dev) != 2 {
+		return m, fmt.Errorf("Invalid device in mountinfo line %q", line)
+	}
+
+	major, err := strconv.ParseUint(dev[0], 10, 32)
+	if err != nil {
+		return m, fmt.Errorf("Invalid device major in mountinfo line %q: %v", line, err)
+	}
+
+	minor, err := strconv.ParseUint(dev[1], 10, 32)
+	if err != nil {
+		return m, fmt.Errorf("Invalid device minor in mountinfo line %q: %v", line, err)
+	}
+
+	m.Major = uint32(major)
+	m.Minor = uint32(minor)
+	m.Root = UnescapeOctalPath(fields[3])
+	m.MountPoint = UnescapeOctalPath(fields[4])
+	m.Options = fields[5]
+	if sep > 6 {
+		m.OptionalFields = fields[6:sep]
+	}
+	m.FSType = fields[sep+1]
+	m.Source = UnescapeOctalPath(fields[sep+2])
+	m.SuperOptions = fields[sep+3]
+
+	return m, nil
+}
+
+// UnescapeOctalPath decodes the octal escapes, e.g. "\040" for a space,
+// the kernel uses in the paths it lists in /proc files like mountinfo or
+// mounts. A backslash that does not start a valid escape is kept as is.
+func UnescapeOctalPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctalEscape(s[i+1:i+4]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// isOctalEscape returns true if s is made of three octal digits encoding
+// a byte value.
+func isOctalEscape(s string) bool {
+	if s[0] < '0' || s[0] > '3' {
+		return false
+	}
+
+	for i := 1; i < 3; i++ {
+		if s[i] < '0' || s[i] > '7' {
+			return false
+		}
+	}
+
+	return true
+}
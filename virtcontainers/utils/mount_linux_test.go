@@ -0,0 +1,448 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	ktu "github.com/kata-containers/runtime/pkg/katatestutils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestBindMount(t *testing.T) {
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "bind")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "source")
+	target := filepath.Join(dir, "target")
+	assert.NoError(os.Mkdir(source, 0755))
+	assert.NoError(os.Mkdir(target, 0755))
+
+	for _, readonly := range []bool{false, true} {
+		err = BindMount(source, target, readonly)
+		assert.NoError(err)
+
+		err = ioutil.WriteFile(filepath.Join(target, "file"), []byte("data"), 0644)
+		if readonly {
+			assert.Error(err)
+			assert.True(os.IsPermission(err) || isErrno(err, syscall.EROFS), "%v", err)
+		} else {
+			assert.NoError(err)
+			_, err = os.Stat(filepath.Join(source, "file"))
+			assert.NoError(err)
+		}
+
+		assert.NoError(syscall.Unmount(target, 0))
+	}
+
+	assert.Error(BindMount("", target, false))
+	assert.Error(BindMount(source, "", false))
+	assert.Error(BindMount(filepath.Join(dir, "does-not-exist"), target, false))
+}
+
+// isErrno returns true if err is, or wraps, errno.
+func isErrno(err error, errno syscall.Errno) bool {
+	switch e := err.(type) {
+	case syscall.Errno:
+		return e == errno
+	case *os.PathError:
+		return isErrno(e.Err, errno)
+	case *os.SyscallError:
+		return isErrno(e.Err, errno)
+	}
+
+	return false
+}
+
+func TestUnmount(t *testing.T) {
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	assert := assert.New(t)
+
+	target, err := ioutil.TempDir("", "unmount")
+	assert.NoError(err)
+	defer os.RemoveAll(target)
+
+	assert.NoError(syscall.Mount("tmpfs", target, "tmpfs", 0, ""))
+	assert.NoError(Unmount(target, UnmountOptions{}))
+
+	// Not mounted anymore
+	assert.Error(Unmount(target, UnmountOptions{Lazy: true}))
+
+	// Keep the mount busy with an open file.
+	assert.NoError(syscall.Mount("tmpfs", target, "tmpfs", 0, ""))
+	f, err := os.Create(filepath.Join(target, "file"))
+	assert.NoError(err)
+	defer f.Close()
+
+	err = Unmount(target, UnmountOptions{})
+	assert.Error(err)
+	assert.Contains(err.Error(), "normal unmount")
+
+	err = Unmount(target, UnmountOptions{Force: true})
+	assert.Error(err)
+	assert.Contains(err.Error(), "forced unmount")
+
+	assert.NoError(Unmount(target, UnmountOptions{Force: true, Lazy: true}))
+
+	assert.Error(Unmount("", UnmountOptions{}))
+}
+
+func TestParseMountInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	mountinfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 propagate_from:2 - ext3 /dev/root rw,errors=continue
+45 22 0:40 / /mnt/with\040space rw,nosuid,nodev - tmpfs tmp\040fs rw,size=1024k
+46 22 0:41 /dir\134name /mnt/tab\011and\012newline ro - fuse.sshfs user@host:/remote\040dir rw,user_id=0
+
+`
+
+	mounts, err := ParseMountInfo(strings.NewReader(mountinfo))
+	assert.NoError(err)
+	assert.Len(mounts, 4)
+
+	assert.Equal(MountInfo{
+		MountID:        22,
+		ParentID:       1,
+		Major:          8,
+		Minor:          1,
+		Root:           "/",
+		MountPoint:     "/",
+		Options:        "rw,relatime",
+		OptionalFields: []string{"shared:1"},
+		FSType:         "ext4",
+		Source:         "/dev/sda1",
+		SuperOptions:   "rw,errors=remount-ro",
+	}, mounts[0])
+
+	assert.Equal([]string{"master:1", "propagate_from:2"}, mounts[1].OptionalFields)
+	assert.Equal("ext3", mounts[1].FSType)
+	assert.Equal(uint32(98), mounts[1].Major)
+
+	// Escaped paths are decoded.
+	assert.Nil(mounts[2].OptionalFields)
+	assert.Equal("/mnt/with space", mounts[2].MountPoint)
+	assert.Equal("tmp fs", mounts[2].Source)
+	assert.Equal("rw,size=1024k", mounts[2].SuperOptions)
+
+	assert.Equal(`/dir\name`, mounts[3].Root)
+	assert.Equal("/mnt/tab\tand\nnewline", mounts[3].MountPoint)
+	assert.Equal("fuse.sshfs", mounts[3].FSType)
+	assert.Equal("user@host:/remote dir", mounts[3].Source)
+}
+
+func TestParseMountInfoInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	lines := []string{
+		"22 1 8:1 / / rw,relatime shared:1 ext4 /dev/sda1 rw",
+		"22 1 8:1 / / rw,relatime - ext4 /dev/sda1",
+		"22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw extra",
+		"a 1 8:1 / / rw - ext4 /dev/sda1 rw",
+		"22 b 8:1 / / rw - ext4 /dev/sda1 rw",
+		"22 1 8 / / rw - ext4 /dev/sda1 rw",
+		"22 1 x:1 / / rw - ext4 /dev/sda1 rw",
+		"22 1 8:y / / rw - ext4 /dev/sda1 rw",
+		"22 1 8:1 /",
+	}
+
+	for _, line := range lines {
+		_, err := ParseMountInfo(strings.NewReader(line + "\n"))
+		assert.Error(err, line)
+	}
+}
+
+func TestParseProcMounts(t *testing.T) {
+	assert := assert.New(t)
+
+	procMounts := `/dev/sda1 / ext4 rw,relatime,errors=remount-ro 0 0
+tmp\040fs /mnt/with\040space tmpfs rw,nosuid,nodev,size=1024k 0 0
+user@host:/remote\040dir /mnt/tab\011and\012newline fuse.sshfs ro,user_id=0 0 0
+
+`
+
+	mounts, err := ParseProcMounts(strings.NewReader(procMounts))
+	assert.NoError(err)
+	assert.Equal([]Mount{
+		{Source: "/dev/sda1", MountPoint: "/", FSType: "ext4", Options: "rw,relatime,errors=remount-ro"},
+		{Source: "tmp fs", MountPoint: "/mnt/with space", FSType: "tmpfs", Options: "rw,nosuid,nodev,size=1024k"},
+		{Source: "user@host:/remote dir", MountPoint: "/mnt/tab\tand\nnewline", FSType: "fuse.sshfs", Options: "ro,user_id=0"},
+	}, mounts)
+
+	for _, line := range []string{
+		"/dev/sda1 / ext4 rw 0",
+		"/dev/sda1 / ext4 rw 0 0 0",
+		"/dev/sda1 / ext4 rw x 0",
+		"/dev/sda1 / ext4 rw 0 y",
+		"22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw",
+	} {
+		_, err := ParseProcMounts(strings.NewReader(line + "\n"))
+		assert.Error(err, line)
+	}
+}
+
+func TestProcMountsFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "mounts")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	orgMountInfoPath := mountInfoPath
+	orgProcMountsPath := procMountsPath
+	defer func() {
+		mountInfoPath = orgMountInfoPath
+		procMountsPath = orgProcMountsPath
+	}()
+	mountInfoPath = filepath.Join(dir, "does-not-exist")
+	procMountsPath = filepath.Join(dir, "mounts")
+
+	_, err = MountIsReadOnly("/")
+	assert.Error(err)
+
+	assert.NoError(ioutil.WriteFile(procMountsPath, []byte("/dev/sda1 / ext4 ro,relatime 0 0\n"), 0644))
+
+	ro, err := MountIsReadOnly("/")
+	assert.NoError(err)
+	assert.True(ro)
+
+	assert.NoError(WaitForMount(context.Background(), "/", time.Hour))
+
+	// Sources which are not devices are skipped.
+	assert.NoError(ioutil.WriteFile(procMountsPath, []byte("tmpfs /tmp tmpfs rw 0 0\n/does/not/exist /mnt ext4 rw 0 0\n"), 0644))
+	mountPoints, err := deviceMountPoints(0, 0)
+	assert.NoError(err)
+	assert.Empty(mountPoints)
+
+	// The device comes from the mount point.
+	procMountsPath = orgProcMountsPath
+	loop, mountPoint, cleanup := setupMountedLoopDevice(t, 16<<20, "ext4")
+	defer cleanup()
+
+	disk, err := DeviceForMount(mountPoint)
+	assert.NoError(err)
+	same, err := SameDevice(loop, disk)
+	assert.NoError(err)
+	assert.True(same)
+
+	// The device numbers come from the source.
+	var st unix.Stat_t
+	assert.NoError(unix.Stat(loop, &st))
+	mountPoints, err = deviceMountPoints(unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)))
+	assert.NoError(err)
+	assert.Equal([]string{mountPoint}, mountPoints)
+}
+
+func TestUnescapeOctalPath(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		s        string
+		expected string
+	}{
+		{"/mnt/plain", "/mnt/plain"},
+		{`/mnt/with\040space`, "/mnt/with space"},
+		{`/mnt/tab\011`, "/mnt/tab\t"},
+		{`/mnt/new\012line`, "/mnt/new\nline"},
+		{`/mnt/back\134slash`, `/mnt/back\slash`},
+		{`\040\040`, "  "},
+		{`/mnt/literal\back`, `/mnt/literal\back`},
+		{`/mnt/short\04`, `/mnt/short\04`},
+		{`/mnt/not\089octal`, `/mnt/not\089octal`},
+		{`/mnt/too\777big`, `/mnt/too\777big`},
+		{`/mnt/trailing\`, `/mnt/trailing\`},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.expected, UnescapeOctalPath(test.s), test.s)
+	}
+}
+
+// setupMountedLoopDevice creates a loop device of size bytes with a fstype
+// filesystem mounted on a temporary directory.
+func setupMountedLoopDevice(t *testing.T, size int64, fstype string) (string, string, func()) {
+	mkfs := "mkfs." + fstype
+	if _, err := exec.LookPath(mkfs); err != nil {
+		t.Skipf("%s not available", mkfs)
+	}
+
+	loop, loopCleanup := setupLoopDevice(t, size)
+
+	if out, err := exec.Command(mkfs, "-q", loop).CombinedOutput(); err != nil {
+		loopCleanup()
+		t.Fatalf("%s failed: %v: %s", mkfs, err, out)
+	}
+
+	mountPoint, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		loopCleanup()
+		t.Fatal(err)
+	}
+
+	if err := syscall.Mount(loop, mountPoint, fstype, 0, ""); err != nil {
+		os.Remove(mountPoint)
+		loopCleanup()
+		t.Skipf("Could not mount %s: %v", loop, err)
+	}
+
+	return loop, mountPoint, func() {
+		syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+		os.Remove(mountPoint)
+		loopCleanup()
+	}
+}
+
+func TestMountedFilesystemUUID(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := MountedFilesystemUUID("/does/not/exist")
+	assert.Error(err)
+
+	dir, err := ioutil.TempDir("", "uuid")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	_, err = DeviceForMount(dir)
+	assert.Error(err)
+
+	// Not backed by a block device.
+	_, err = MountedFilesystemUUID("/proc")
+	assert.Error(err)
+
+	if _, err := exec.LookPath("blkid"); err != nil {
+		t.Skip("blkid not available")
+	}
+
+	loop, mountPoint, cleanup := setupMountedLoopDevice(t, 16<<20, "ext4")
+	defer cleanup()
+
+	out, err := exec.Command("blkid", "-s", "UUID", "-o", "value", loop).Output()
+	assert.NoError(err)
+
+	disk, err := DeviceForMount(mountPoint)
+	assert.NoError(err)
+	assert.Equal(loop, disk)
+
+	uuid, err := MountedFilesystemUUID(mountPoint)
+	assert.NoError(err)
+	assert.Equal(strings.TrimSpace(string(out)), uuid)
+}
+
+func TestMountIsReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ro")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	_, err = MountIsReadOnly(dir)
+	assert.Error(err)
+	assert.Contains(err.Error(), "not a mount point")
+
+	_, err = MountIsReadOnly(filepath.Join(dir, "does-not-exist"))
+	assert.Error(err)
+
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	for _, readonly := range []bool{false, true} {
+		var flags uintptr
+		if readonly {
+			flags = syscall.MS_RDONLY
+		}
+		assert.NoError(syscall.Mount("tmpfs", dir, "tmpfs", flags, ""))
+
+		ro, err := MountIsReadOnly(dir)
+		assert.NoError(err)
+		assert.Equal(readonly, ro)
+
+		assert.NoError(syscall.Unmount(dir, 0))
+	}
+
+	// Read-only bind mount of a read-write filesystem.
+	source := filepath.Join(dir, "source")
+	target := filepath.Join(dir, "target")
+	assert.NoError(os.Mkdir(source, 0755))
+	assert.NoError(os.Mkdir(target, 0755))
+	assert.NoError(BindMount(source, target, true))
+	defer syscall.Unmount(target, 0)
+
+	ro, err := MountIsReadOnly(target)
+	assert.NoError(err)
+	assert.True(ro)
+}
+
+func TestHasMountOption(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(hasMountOption("ro", "ro"))
+	assert.True(hasMountOption("rw,nosuid,ro", "ro"))
+	assert.False(hasMountOption("rw,errors=remount-ro", "ro"))
+	assert.False(hasMountOption("", "ro"))
+}
+
+func TestWaitForMount(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "wait")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = WaitForMount(ctx, filepath.Join(dir, "does-not-exist"), time.Millisecond)
+	assert.Error(err)
+	assert.Contains(err.Error(), "Nothing mounted")
+
+	assert.Error(WaitForMount(context.Background(), dir, 0))
+
+	// Already mounted
+	assert.NoError(WaitForMount(context.Background(), "/", time.Hour))
+
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	mountPoint := filepath.Join(dir, "mnt")
+	mounted := make(chan error, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		if err := os.Mkdir(mountPoint, 0755); err != nil {
+			mounted <- err
+			return
+		}
+		mounted <- syscall.Mount("tmpfs", mountPoint, "tmpfs", 0, "")
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = WaitForMount(ctx, mountPoint, 5*time.Millisecond)
+	if assert.NoError(<-mounted) {
+		defer syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+		assert.NoError(err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/procfs"
+)
+
+// mountNamespace returns the identifier of the mount namespace of pid,
+// e.g. "mnt:[4026531840]".
+func mountNamespace(pid int) (string, error) {
+	ns, err := os.Readlink(filepath.Join(procfs.DefaultMountPoint, strconv.Itoa(pid), "ns", "mnt"))
+	if os.IsPermission(err) {
+		return "", errors.Wrapf(err, "Not allowed to inspect the mount namespace of pid %v", pid)
+	} else if err != nil {
+		return "", errors.Wrapf(err, "Could not get the mount namespace of pid %v", pid)
+	}
+
+	return ns, nil
+}
+
+// SameMountNamespace returns true if the processes pid1 and pid2 are in the
+// same mount namespace. Inspecting the namespace of a process owned by
+// another user takes privileges, an error is returned without them.
+func SameMountNamespace(pid1, pid2 int) (bool, error) {
+	ns1, err := mountNamespace(pid1)
+	if err != nil {
+		return false, err
+	}
+
+	ns2, err := mountNamespace(pid2)
+	if err != nil {
+		return false, err
+	}
+
+	return ns1 == ns2, nil
+}
+
+// InMountNamespace returns true if path, as seen by the current process,
+// is the same file at the same path in the mount namespace of pid, e.g. to
+// check that a mount set up for a sandbox is visible from inside it. It
+// returns false if path does not exist in the namespace of pid, or is
+// another file there.
+func InMountNamespace(path string, pid int) (bool, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+
+	local, err := os.Stat(abs)
+	if err != nil {
+		return false, err
+	}
+
+	procDir := filepath.Join(procfs.DefaultMountPoint, strconv.Itoa(pid))
+	if _, err := os.Stat(procDir); err != nil {
+		return false, errors.Wrapf(err, "Invalid pid %v", pid)
+	}
+
+	remote, err := os.Stat(filepath.Join(procDir, "root", abs))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if os.IsPermission(err) {
+		return false, errors.Wrapf(err, "Not allowed to inspect the mount namespace of pid %v", pid)
+	} else if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(local, remote), nil
+}
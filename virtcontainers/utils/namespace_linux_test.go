@@ -0,0 +1,91 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	ktu "github.com/kata-containers/runtime/pkg/katatestutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSameMountNamespace(t *testing.T) {
+	assert := assert.New(t)
+
+	same, err := SameMountNamespace(os.Getpid(), os.Getpid())
+	assert.NoError(err)
+	assert.True(same)
+
+	// Not a valid pid.
+	_, err = SameMountNamespace(os.Getpid(), -1)
+	assert.Error(err)
+}
+
+func TestInMountNamespace(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ns")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	in, err := InMountNamespace(dir, os.Getpid())
+	assert.NoError(err)
+	assert.True(in)
+
+	_, err = InMountNamespace(filepath.Join(dir, "does-not-exist"), os.Getpid())
+	assert.Error(err)
+
+	_, err = InMountNamespace(dir, -1)
+	assert.Error(err)
+}
+
+func TestMountNamespaceUnshared(t *testing.T) {
+	if tc.NotValid(ktu.NeedRoot()) {
+		t.Skip(testDisabledAsNonRoot)
+	}
+
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare not available")
+	}
+
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "ns")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// The child mounts a tmpfs over dir in its own mount namespace.
+	cmd := exec.Command("unshare", "--mount", "--propagation", "private", "sh", "-c",
+		"mount -t tmpfs tmpfs "+dir+" && touch "+dir+"/ready && sleep 10")
+	assert.NoError(cmd.Start())
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// Wait for the child to enter its namespace.
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "root", dir, "ready")); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// cmd.Process is unshare, which execs sh in the new namespace.
+	same, err := SameMountNamespace(os.Getpid(), cmd.Process.Pid)
+	assert.NoError(err)
+	assert.False(same)
+
+	in, err := InMountNamespace(dir, cmd.Process.Pid)
+	assert.NoError(err)
+	assert.False(in)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mdMagic starts the md RAID superblocks, see <linux/raid/md_p.h>
+const mdMagic = 0xa92b4efc
+
+const (
+	// mdReservedBytes is the space reserved at the end of the members
+	// for the 0.90 superblock.
+	mdReservedBytes = 64 << 10
+
+	// mdV12Offset is the offset of the 1.2 superblock, the default one.
+	mdV12Offset = 4 << 10
+)
+
+// mdSuperblockOffsets returns the offsets where a md superblock could be
+// found on a device of size bytes, according to the metadata versions.
+func mdSuperblockOffsets(size int64) []int64 {
+	// 1.1 and 1.2 live at the start of the device.
+	offsets := []int64{0, mdV12Offset}
+
+	// 1.0 lives 8KiB from the end, 4KiB aligned.
+	if size >= 16*sectorSize {
+		offsets = append(offsets, (size/sectorSize-16)&^7*sectorSize)
+	}
+
+	// 0.90 lives in the last 64KiB aligned 64KiB block.
+	if size >= 2*mdReservedBytes {
+		offsets = append(offsets, size&^(mdReservedBytes-1)-mdReservedBytes)
+	}
+
+	return offsets
+}
+
+// hasMDSuperblock returns true if r, of size bytes, holds a md superblock.
+func hasMDSuperblock(r io.ReaderAt, size int64) (bool, error) {
+	buf := make([]byte, 4)
+	for _, offset := range mdSuperblockOffsets(size) {
+		if _, err := r.ReadAt(buf, offset); err == io.EOF {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		// The 0.90 superblock is in host byte order.
+		if binary.LittleEndian.Uint32(buf) == mdMagic || binary.BigEndian.Uint32(buf) == mdMagic {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// IsRaidMember returns true if disk is a member of a md RAID array, in
+// which case the array device should be used instead: writing to a member
+// directly corrupts the array. Members of running arrays are found from
+// their holders, the others from their md superblock.
+func IsRaidMember(disk string) (bool, error) {
+	// Disk images have no holders.
+	if holders, err := BlockDeviceHolders(disk); err == nil {
+		for _, h := range holders {
+			if strings.HasPrefix(filepath.Base(h), "md") {
+				return true, nil
+			}
+		}
+	}
+
+	f, err := os.Open(disk)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	size, err := deviceSize(f)
+	if err != nil {
+		return false, err
+	}
+
+	return hasMDSuperblock(f, size)
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeMDImage creates a disk image of size bytes with a md superblock
+// at offset, if offset is not negative.
+func writeMDImage(t *testing.T, size, offset int64, order binary.ByteOrder) string {
+	f, err := ioutil.TempFile("", "md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	if offset >= 0 {
+		buf := make([]byte, 4)
+		order.PutUint32(buf, mdMagic)
+		if _, err := f.WriteAt(buf, offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return f.Name()
+}
+
+func TestIsRaidMember(t *testing.T) {
+	assert := assert.New(t)
+
+	const size = 10<<20 + 3*512
+
+	for _, d := range []struct {
+		offset int64
+		order  binary.ByteOrder
+		member bool
+	}{
+		{-1, binary.LittleEndian, false},
+		// 1.1
+		{0, binary.LittleEndian, true},
+		// 1.2
+		{4096, binary.LittleEndian, true},
+		// 1.0
+		{10<<20 - 8192, binary.LittleEndian, true},
+		// 0.90
+		{10<<20 - 65536, binary.LittleEndian, true},
+		{10<<20 - 65536, binary.BigEndian, true},
+		// Not a superblock offset
+		{512, binary.LittleEndian, false},
+	} {
+		image := writeMDImage(t, size, d.offset, d.order)
+		defer os.Remove(image)
+
+		member, err := IsRaidMember(image)
+		assert.NoError(err, "offset %d", d.offset)
+		assert.Equal(d.member, member, "offset %d", d.offset)
+	}
+
+	// Too small for any superblock
+	image := writeMDImage(t, 1024, -1, binary.LittleEndian)
+	defer os.Remove(image)
+	member, err := IsRaidMember(image)
+	assert.NoError(err)
+	assert.False(member)
+
+	_, err = IsRaidMember(image + "-does-not-exist")
+	assert.Error(err)
+}
+
+func TestIsRaidMemberHolders(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	sda := sysfs.addDisk("sda", nil)
+	sdb := sysfs.addDisk("sdb", nil)
+	sysfs.addDisk("md0", nil)
+	sysfs.addDisk("dm-0", nil)
+
+	for disk, holder := range map[string]string{"sda": "md0", "sdb": "dm-0"} {
+		dir := filepath.Join(sysfs.root, "block", disk, "holders")
+		assert.NoError(os.MkdirAll(dir, 0755))
+		assert.NoError(os.Symlink(filepath.Join(sysfs.root, "block", holder), filepath.Join(dir, holder)))
+	}
+
+	member, err := IsRaidMember(sda)
+	assert.NoError(err)
+	assert.True(member)
+
+	member, err = IsRaidMember(sdb)
+	assert.NoError(err)
+	assert.False(member)
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"hash"
+	"os"
+)
+
+// regionChunkSize is the size of the reads issued when going through a
+// device region, a multiple of any logical block size.
+const regionChunkSize = 1 << 20
+
+// deviceSize returns the size of f, a block device or a regular file, e.g.
+// a disk image.
+func deviceSize(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if fi.Mode()&os.ModeDevice == 0 {
+		return fi.Size(), nil
+	}
+
+	size, err := blockDeviceSize(f)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(size), nil
+}
+
+// checkRegion checks that the region of length bytes from offset fits in
+// f, named disk in errors.
+func checkRegion(f *os.File, disk string, offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("Invalid region %d+%d", offset, length)
+	}
+
+	size, err := deviceSize(f)
+	if err != nil {
+		return err
+	}
+
+	if offset > size || length > size-offset {
+		return fmt.Errorf("Region %d+%d does not fit in %v of %d bytes", offset, length, disk, size)
+	}
+
+	return nil
+}
+
+// HashDeviceRegion writes the length bytes of disk from offset to h, e.g.
+// to check what was written to a device. disk can be a block device or a
+// regular file, the region must fit in it. Reads are aligned on 1MiB
+// boundaries, but for the first and the last one.
+func HashDeviceRegion(disk string, offset, length int64, h hash.Hash) error {
+	f, err := os.Open(disk)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := checkRegion(f, disk, offset, length); err != nil {
+		return err
+	}
+
+	return readRegion(f, disk, offset, length, func(chunk []byte) bool {
+		h.Write(chunk)
+		return true
+	})
+}
+
+// readRegion reads the length bytes of f, named disk in errors, from
+// offset and passes them to fn, in chunks aligned on 1MiB boundaries but
+// for the first and the last one, until fn returns false. Chunks are
+// smaller on block devices that do not take 1MiB requests, see
+// MaxSectorsKB.
+func readRegion(f *os.File, disk string, offset, length int64, fn func(chunk []byte) bool) error {
+	chunkSize := capRequestSize(f, disk, regionChunkSize)
+	buf := make([]byte, chunkSize)
+	end := offset + length
+
+	for pos := offset; pos < end; {
+		// Stop at the next chunk boundary.
+		n := chunkSize - pos%chunkSize
+		if n > end-pos {
+			n = end - pos
+		}
+
+		read, err := f.ReadAt(buf[:n], pos)
+		if err != nil {
+			return fmt.Errorf("Could not read %v at %d: %v", disk, pos+int64(read), err)
+		}
+
+		if !fn(buf[:read]) {
+			return nil
+		}
+		pos += int64(read)
+	}
+
+	return nil
+}
+
+// IsDeviceZeroed returns true if disk, a block device or a regular file,
+// only holds zeroes, e.g. to check a device is blank before provisioning
+// it. Unless sampleRegions is 0 or less, only that many 1MiB regions spread
+// evenly across disk, starting with the first one and ending with the last
+// one, are checked: a sampled check can miss data elsewhere, a full check
+// reads the whole device.
+func IsDeviceZeroed(disk string, sampleRegions int) (bool, error) {
+	f, err := os.Open(disk)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	size, err := deviceSize(f)
+	if err != nil {
+		return false, err
+	}
+
+	zeroed := true
+	isZero := func(chunk []byte) bool {
+		for _, b := range chunk {
+			if b != 0 {
+				zeroed = false
+				return false
+			}
+		}
+		return true
+	}
+
+	chunks := (size + regionChunkSize - 1) / regionChunkSize
+	if sampleRegions <= 0 || int64(sampleRegions) >= chunks {
+		err := readRegion(f, disk, 0, size, isZero)
+		return zeroed, err
+	}
+
+	for i := int64(0); i < int64(sampleRegions) && zeroed; i++ {
+		var chunk int64
+		if sampleRegions > 1 {
+			chunk = i * (chunks - 1) / int64(sampleRegions-1)
+		}
+
+		offset := chunk * regionChunkSize
+		length := int64(regionChunkSize)
+		if length > size-offset {
+			length = size - offset
+		}
+
+		if err := readRegion(f, disk, offset, length, isZero); err != nil {
+			return false, err
+		}
+	}
+
+	return zeroed, nil
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashDeviceRegion(t *testing.T) {
+	assert := assert.New(t)
+
+	data := make([]byte, 3<<20+1234)
+	rand.Read(data)
+
+	f, err := ioutil.TempFile("", "region")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	assert.NoError(err)
+	f.Close()
+
+	tests := []struct {
+		offset, length int64
+	}{
+		{0, 0},
+		{0, 4096},
+		{1, 1},
+		{123, 1 << 20},
+		{1<<20 - 1, 2},
+		{0, int64(len(data))},
+		{1 << 20, 2<<20 + 1234},
+	}
+
+	check := func(disk string) {
+		for _, test := range tests {
+			h := sha256.New()
+			assert.NoError(HashDeviceRegion(disk, test.offset, test.length, h))
+
+			expected := sha256.Sum256(data[test.offset : test.offset+test.length])
+			assert.Equal(expected[:], h.Sum(nil), "%s %+v", disk, test)
+		}
+	}
+
+	check(f.Name())
+
+	h := sha256.New()
+	assert.Error(HashDeviceRegion(f.Name(), 0, int64(len(data))+1, h))
+	assert.Error(HashDeviceRegion(f.Name(), int64(len(data)), 1, h))
+	assert.Error(HashDeviceRegion(f.Name(), -1, 1, h))
+	assert.Error(HashDeviceRegion("/does/not/exist", 0, 1, h))
+
+	loop, cleanup := setupLoopDevice(t, int64(4<<20))
+	defer cleanup()
+	assert.NoError(ioutil.WriteFile(loop, data, 0))
+
+	check(loop)
+	assert.Error(HashDeviceRegion(loop, 4<<20, 1, h))
+
+	// Reads are capped to max_sectors_kb.
+	sysfs, sysfsCleanup := newTestSysfs(t)
+	defer sysfsCleanup()
+	sysfs.addDisk(filepath.Base(loop), map[string]string{"queue/max_sectors_kb": "64"})
+
+	check(loop)
+
+	rh := &recordingHash{Hash: sha256.New()}
+	assert.NoError(HashDeviceRegion(loop, 0, int64(len(data)), rh))
+	assert.Equal(len(data)/(64<<10)+1, len(rh.sizes))
+	for _, size := range rh.sizes {
+		assert.True(size <= 64<<10, "size %d", size)
+	}
+}
+
+// recordingHash records the size of the writes to the hash.
+type recordingHash struct {
+	hash.Hash
+	sizes []int
+}
+
+func (h *recordingHash) Write(p []byte) (int, error) {
+	h.sizes = append(h.sizes, len(p))
+	return h.Hash.Write(p)
+}
+
+func TestIsDeviceZeroed(t *testing.T) {
+	assert := assert.New(t)
+
+	const size = 10<<20 + 4096
+
+	f, err := ioutil.TempFile("", "zeroed")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+	assert.NoError(f.Truncate(size))
+	defer f.Close()
+
+	for _, samples := range []int{0, 1, 2, 5, 100} {
+		zeroed, err := IsDeviceZeroed(f.Name(), samples)
+		assert.NoError(err)
+		assert.True(zeroed, "samples %d", samples)
+	}
+
+	// Dirty last byte, always sampled.
+	_, err = f.WriteAt([]byte{1}, size-1)
+	assert.NoError(err)
+	for _, samples := range []int{0, 2, 5} {
+		zeroed, err := IsDeviceZeroed(f.Name(), samples)
+		assert.NoError(err)
+		assert.False(zeroed, "samples %d", samples)
+	}
+
+	// Only a single sample, of the first region.
+	zeroed, err := IsDeviceZeroed(f.Name(), 1)
+	assert.NoError(err)
+	assert.True(zeroed)
+
+	// Dirty byte between the samples, only found by a full scan.
+	_, err = f.WriteAt([]byte{0}, size-1)
+	assert.NoError(err)
+	_, err = f.WriteAt([]byte{1}, 3<<20+10)
+	assert.NoError(err)
+
+	zeroed, err = IsDeviceZeroed(f.Name(), 2)
+	assert.NoError(err)
+	assert.True(zeroed)
+
+	zeroed, err = IsDeviceZeroed(f.Name(), 0)
+	assert.NoError(err)
+	assert.False(zeroed)
+
+	_, err = IsDeviceZeroed("/does/not/exist", 0)
+	assert.Error(err)
+
+	loop, cleanup := setupLoopDevice(t, 4<<20)
+	defer cleanup()
+
+	zeroed, err = IsDeviceZeroed(loop, 3)
+	assert.NoError(err)
+	assert.True(zeroed)
+
+	assert.NoError(ioutil.WriteFile(loop, []byte("dirty"), 0))
+	zeroed, err = IsDeviceZeroed(loop, 3)
+	assert.NoError(err)
+	assert.False(zeroed)
+}
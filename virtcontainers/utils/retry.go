@@ -0,0 +1,68 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// retryAfter returns a channel that receives after d.
+// It is a variable so tests can replace it.
+var retryAfter = time.After
+
+// RetryWithBackoff calls fn until it is done, returns an error, or ctx is
+// done. The delay between two calls starts at initial and doubles up to
+// max. Every delay is picked at random within its upper half, so that
+// concurrent callers polling the same resource drift apart instead of
+// waking up together. It returns the error of fn or of ctx, or nil once fn
+// is done.
+func RetryWithBackoff(ctx context.Context, initial, max time.Duration, fn func() (bool, error)) error {
+	if initial <= 0 || max < initial {
+		return fmt.Errorf("Invalid backoff, initial %v must be positive and not greater than max %v", initial, max)
+	}
+
+	delay := initial
+	for {
+		done, err := fn()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-retryAfter(jitter(delay)):
+		}
+
+		if delay < max/2 {
+			delay *= 2
+		} else {
+			delay = max
+		}
+	}
+}
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(d-half)+1))
+	if err != nil {
+		return d
+	}
+
+	return half + time.Duration(n.Int64())
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryWithBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	orgRetryAfter := retryAfter
+	defer func() {
+		retryAfter = orgRetryAfter
+	}()
+
+	var delays []time.Duration
+	retryAfter = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		c := make(chan time.Time, 1)
+		c <- time.Now()
+		return c
+	}
+
+	calls := 0
+	err := RetryWithBackoff(context.Background(), 10*time.Millisecond, 100*time.Millisecond, func() (bool, error) {
+		calls++
+		return calls == 8, nil
+	})
+	assert.NoError(err)
+	assert.Equal(8, calls)
+
+	// 10, 20, 40, 80, then capped to 100.
+	expected := []time.Duration{10, 20, 40, 80, 100, 100, 100}
+	assert.Len(delays, len(expected))
+	for i, d := range delays {
+		max := expected[i] * time.Millisecond
+		assert.True(d >= max/2 && d <= max, "delay %d: %v not in [%v, %v]", i, d, max/2, max)
+	}
+
+	// Errors stop the retries.
+	delays = nil
+	err = RetryWithBackoff(context.Background(), time.Millisecond, time.Millisecond, func() (bool, error) {
+		return false, errors.New("failed")
+	})
+	assert.Error(err)
+	assert.Empty(delays)
+
+	assert.Error(RetryWithBackoff(context.Background(), 0, time.Millisecond, nil))
+	assert.Error(RetryWithBackoff(context.Background(), time.Second, time.Millisecond, nil))
+
+	// Cancelled context
+	retryAfter = orgRetryAfter
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = RetryWithBackoff(ctx, time.Millisecond, 2*time.Millisecond, func() (bool, error) {
+		return false, nil
+	})
+	assert.Equal(context.DeadlineExceeded, err)
+}
+
+func TestJitter(t *testing.T) {
+	assert := assert.New(t)
+
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.True(d >= time.Second/2 && d <= time.Second)
+	}
+
+	assert.Equal(time.Duration(1), jitter(1))
+}
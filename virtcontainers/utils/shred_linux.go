@@ -0,0 +1,226 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// shredChunkSize is the size of the writes issued by ShredDeviceRange, a
+// multiple of any logical block size, unless the device takes smaller
+// requests, see MaxSectorsKB.
+const shredChunkSize = 1 << 20
+
+// from <linux/fs.h>
+// BLKZEROOUT = _IO(0x12, 127)
+const ioctlBlkZeroOut = 0x127f
+
+// ShredDevice overwrites the whole block device disk with random data
+// passes times, then with zeroes, see ShredDeviceRange.
+//
+// WARNING: this destroys all the data on disk.
+func ShredDevice(disk string, passes int) error {
+	size, err := GetBlockDeviceSize(disk)
+	if err != nil {
+		return err
+	}
+
+	return ShredDeviceRange(disk, 0, size, passes)
+}
+
+// ShredDeviceRange overwrites length bytes of the block device disk from
+// offset with random data passes times, then with zeroes. offset and length
+// must be multiples of 512 bytes and the range must fit in the device.
+// The root device, see IsRootDevice, and a device that is mounted, or any
+// of its partitions, or that is held by another device, e.g. device
+// mapper, are refused.
+//
+// WARNING: this destroys the data in the range.
+//
+// Overwriting does not reach the blocks that wear-leveling or
+// over-provisioning keep out of the logical address space of flash
+// devices, so data might still be recovered from SSDs. Discarding the
+// whole device, or erasing the key of a device that was encrypted from the
+// start, is the way to go there.
+func ShredDeviceRange(disk string, offset, length uint64, passes int) error {
+	if passes < 1 {
+		return fmt.Errorf("Invalid number of passes %d, at least 1 is expected", passes)
+	}
+
+	if offset%sectorSize != 0 || length%sectorSize != 0 {
+		return fmt.Errorf("Offset %d and length %d must be multiples of %d", offset, length, sectorSize)
+	}
+
+	f, err := openUnusedBlockDevice(disk, "shred", os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := checkDeviceRange(f, disk, offset, length); err != nil {
+		return err
+	}
+
+	buf := make([]byte, capRequestSize(f, disk, shredChunkSize))
+
+	for pass := 0; pass <= passes; pass++ {
+		random := pass < passes
+		if !random {
+			for i := range buf {
+				buf[i] = 0
+			}
+		}
+
+		for done := uint64(0); done < length; {
+			chunk := buf
+			if length-done < uint64(len(chunk)) {
+				chunk = chunk[:length-done]
+			}
+
+			if random {
+				if _, err := rand.Read(chunk); err != nil {
+					return err
+				}
+			}
+
+			n, err := f.WriteAt(chunk, int64(offset+done))
+			if err != nil {
+				return fmt.Errorf("Could not shred %v at %d: %v", disk, offset+done, err)
+			}
+			done += uint64(n)
+		}
+
+		// Make sure every pass reaches the device.
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ZeroOutDevice zeroes length bytes of the block device disk from offset.
+// The BLKZEROOUT ioctl lets the device do it, e.g. with WRITE ZEROES on
+// devices supporting it, which is much faster than writing zeroes. Zeroes
+// are written instead if the kernel does not support the ioctl. offset and
+// length must be multiples of the logical block size of the device, and the
+// range must fit in it. As for ShredDeviceRange, the root device and the
+// devices that are mounted or held are refused.
+//
+// WARNING: this destroys the data in the range.
+func ZeroOutDevice(disk string, offset, length uint64) error {
+	f, err := openUnusedBlockDevice(disk, "zero out", os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := checkDeviceRange(f, disk, offset, length); err != nil {
+		return err
+	}
+
+	var blockSize int32
+	if err := ioctlFunc(f.Fd(), unix.BLKSSZGET, uintptr(unsafe.Pointer(&blockSize))); err != nil {
+		return fmt.Errorf("Could not get the logical block size of %v: %v", disk, err)
+	}
+
+	if err := ValidateAlignedRange(offset, length, uint64(blockSize)); err != nil {
+		return fmt.Errorf("Cannot zero out %v: %v", disk, err)
+	}
+
+	r := [2]uint64{offset, length}
+	err = ioctlFunc(f.Fd(), ioctlBlkZeroOut, uintptr(unsafe.Pointer(&r)))
+
+	switch errno := ioctlErrno(err); {
+	case err == nil:
+		return nil
+	case errno == syscall.EOPNOTSUPP, errno == syscall.ENOTTY:
+		return writeZeroes(f, disk, offset, length)
+	default:
+		return fmt.Errorf("Could not zero out %v at %d+%d: %v", disk, offset, length, err)
+	}
+}
+
+// writeZeroes writes zeroes over length bytes of f, named disk, from
+// offset, and syncs them.
+func writeZeroes(f *os.File, disk string, offset, length uint64) error {
+	buf := make([]byte, capRequestSize(f, disk, shredChunkSize))
+
+	for done := uint64(0); done < length; {
+		chunk := buf
+		if length-done < uint64(len(chunk)) {
+			chunk = chunk[:length-done]
+		}
+
+		n, err := f.WriteAt(chunk, int64(offset+done))
+		if err != nil {
+			return fmt.Errorf("Could not zero out %v at %d: %v", disk, offset+done, err)
+		}
+		done += uint64(n)
+	}
+
+	return f.Sync()
+}
+
+// openUnusedBlockDevice opens the block device disk with flag, which must
+// allow writing, refusing to, for the action, if it is the root device, is
+// mounted or is held by another device. If flag has O_DIRECT, disk is opened
+// without it when the driver does not support it.
+func openUnusedBlockDevice(disk, action string, flag int) (*os.File, error) {
+	if err := checkNotRootDevice(disk); err != nil {
+		return nil, err
+	}
+
+	major, minor, err := DeviceNumbers(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoints, err := deviceMountPoints(major, minor)
+	if err != nil {
+		return nil, err
+	}
+	if len(mountPoints) > 0 {
+		return nil, fmt.Errorf("Refusing to %s %v, it is mounted on %v", action, disk, strings.Join(mountPoints, ", "))
+	}
+
+	open := openBlockDevice
+	if flag&syscall.O_DIRECT != 0 {
+		open = openBlockDeviceDirect
+		flag &^= syscall.O_DIRECT
+	}
+
+	// O_EXCL fails with EBUSY if the device, or one of its partitions, is
+	// mounted or held by another device.
+	f, err := open(disk, flag|syscall.O_EXCL)
+	if err != nil {
+		return nil, fmt.Errorf("Refusing to %s %v: %v", action, disk, err)
+	}
+
+	return f, nil
+}
+
+// checkDeviceRange checks that the range of length bytes from offset fits
+// in the block device f, named disk.
+func checkDeviceRange(f *os.File, disk string, offset, length uint64) error {
+	size, err := blockDeviceSize(f)
+	if err != nil {
+		return err
+	}
+
+	if offset > size || length > size-offset {
+		return fmt.Errorf("Range %d+%d does not fit in %v of %d bytes", offset, length, disk, size)
+	}
+
+	return nil
+}
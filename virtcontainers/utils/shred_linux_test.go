@@ -0,0 +1,147 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShredDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	err := ShredDevice("/dev/null", 1)
+	assert.Error(err)
+
+	loop, cleanup := setupLoopDevice(t, 3<<20+4096)
+	defer cleanup()
+
+	assert.Error(ShredDevice(loop, 0))
+	assert.Error(ShredDeviceRange(loop, 1, 512, 1))
+	assert.Error(ShredDeviceRange(loop, 0, 4<<20, 1))
+
+	data := bytes.Repeat([]byte{0xaa}, 3<<20+4096)
+	assert.NoError(ioutil.WriteFile(loop, data, 0))
+
+	// Only the range is shredded.
+	assert.NoError(ShredDeviceRange(loop, 4096, 8192, 2))
+	content, err := ioutil.ReadFile(loop)
+	assert.NoError(err)
+	assert.Equal(data[:4096], content[:4096])
+	assert.Equal(make([]byte, 8192), content[4096:12288])
+	assert.Equal(data[12288:], content[12288:])
+
+	assert.NoError(ShredDevice(loop, 1))
+	content, err = ioutil.ReadFile(loop)
+	assert.NoError(err)
+	assert.Equal(make([]byte, len(data)), content)
+
+	// Mounted devices are refused.
+	major, minor, err := DeviceNumbers(loop)
+	assert.NoError(err)
+
+	mountInfo, err := ioutil.TempFile("", "mountinfo")
+	assert.NoError(err)
+	defer os.Remove(mountInfo.Name())
+	fmt.Fprintf(mountInfo, "36 35 %d:%d / /mnt rw - ext4 %s rw\n", major, minor, loop)
+	mountInfo.Close()
+
+	orgMountInfoPath := mountInfoPath
+	defer func() {
+		mountInfoPath = orgMountInfoPath
+	}()
+	mountInfoPath = mountInfo.Name()
+
+	err = ShredDevice(loop, 1)
+	assert.Error(err)
+	assert.Contains(err.Error(), "/mnt")
+
+	// Held devices are refused.
+	mountInfoPath = orgMountInfoPath
+	f, err := os.OpenFile(loop, os.O_RDONLY|os.O_EXCL, 0)
+	assert.NoError(err)
+	defer f.Close()
+	assert.Error(ShredDevice(loop, 1))
+}
+
+func TestZeroOutDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+	}()
+	ioctlFunc = Ioctl
+
+	assert.Error(ZeroOutDevice("/dev/null", 0, 512))
+
+	const size = 3<<20 + 4096
+
+	loop, cleanup := setupLoopDevice(t, size)
+	defer cleanup()
+
+	assert.Error(ZeroOutDevice(loop, 1, 512))
+	assert.Error(ZeroOutDevice(loop, 0, 511))
+	assert.Error(ZeroOutDevice(loop, 0, 0))
+	assert.Error(ZeroOutDevice(loop, 4096, size))
+
+	data := bytes.Repeat([]byte{0xaa}, size)
+
+	check := func() {
+		assert.NoError(ioutil.WriteFile(loop, data, 0))
+
+		// Only the range is zeroed.
+		assert.NoError(ZeroOutDevice(loop, 4096, 2<<20))
+		content, err := ioutil.ReadFile(loop)
+		assert.NoError(err)
+		assert.Equal(data[:4096], content[:4096])
+		assert.Equal(make([]byte, 2<<20), content[4096:4096+2<<20])
+		assert.Equal(data[4096+2<<20:], content[4096+2<<20:])
+
+		assert.NoError(ZeroOutDevice(loop, 0, size))
+		zeroed, err := IsDeviceZeroed(loop, 0)
+		assert.NoError(err)
+		assert.True(zeroed)
+	}
+
+	check()
+
+	// Zeroes are written if BLKZEROOUT is not supported.
+	var zeroOutCalls int
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		if request == ioctlBlkZeroOut {
+			zeroOutCalls++
+			return os.NewSyscallError("ioctl", syscall.EOPNOTSUPP)
+		}
+		return Ioctl(fd, request, arg1)
+	}
+
+	check()
+	assert.Equal(2, zeroOutCalls)
+
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		if request == ioctlBlkZeroOut {
+			return os.NewSyscallError("ioctl", syscall.EIO)
+		}
+		return Ioctl(fd, request, arg1)
+	}
+	assert.Error(ZeroOutDevice(loop, 0, size))
+	ioctlFunc = Ioctl
+
+	// Held devices are refused.
+	f, err := os.OpenFile(loop, os.O_RDONLY|os.O_EXCL, 0)
+	assert.NoError(err)
+	defer f.Close()
+	err = ZeroOutDevice(loop, 0, size)
+	assert.Error(err)
+	assert.Contains(err.Error(), "Refusing to zero out")
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FindStaleLoopDevices returns the paths of the loop devices that look
+// orphaned, e.g. left behind by a crashed sandbox: they are attached to a
+// backing file that was removed, are not mounted in the mount namespace of
+// the current process and have no holders.
+//
+// Being stale is a heuristic, a loop device might be mounted in another
+// mount namespace or be opened by a process, e.g. a VMM using it as a
+// disk. Callers should double-check before detaching them.
+func FindStaleLoopDevices() ([]string, error) {
+	return findStaleDevices("loop", func(name string) (bool, error) {
+		backingFile, deleted, err := loopBackingFile(name)
+		if err == ErrNoBackingFile {
+			// Not attached.
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if deleted {
+			return true, nil
+		}
+
+		if _, err := os.Stat(backingFile); os.IsNotExist(err) {
+			return true, nil
+		}
+
+		return false, nil
+	})
+}
+
+// FindStaleDMDevices returns the paths of the device mapper devices that
+// look orphaned: they are not mounted in the mount namespace of the current
+// process and have no holders.
+//
+// Being stale is a heuristic, much weaker than for loop devices since an
+// unused device mapper device, e.g. an LVM volume, is perfectly legitimate.
+// A device might also be mounted in another mount namespace or be opened
+// by a process. Callers should double-check before removing them.
+func FindStaleDMDevices() ([]string, error) {
+	return findStaleDevices("dm-", func(name string) (bool, error) {
+		return true, nil
+	})
+}
+
+// findStaleDevices returns the paths of the block devices whose name
+// starts with prefix that have no holders, are not mounted, and for which
+// stale returns true.
+func findStaleDevices(prefix string, stale func(name string) (bool, error)) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(sysfsRoot, "block"))
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	mounted := make(map[string]bool)
+	for _, m := range mounts {
+		mounted[fmt.Sprintf("%d:%d", m.Major, m.Minor)] = true
+	}
+
+	var devices []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		sysDir := filepath.Join(sysfsRoot, "block", name)
+
+		dev, err := readSysfsString(filepath.Join(sysDir, "dev"))
+		if err != nil {
+			return nil, err
+		}
+		if mounted[dev] {
+			continue
+		}
+
+		holders, err := ioutil.ReadDir(filepath.Join(sysDir, "holders"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(holders) > 0 {
+			continue
+		}
+
+		ok, err := stale(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			devices = append(devices, filepath.Join(devRoot, name))
+		}
+	}
+
+	return devices, nil
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindStaleDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	s, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	orgDevRoot := devRoot
+	orgMountInfoPath := mountInfoPath
+	defer func() {
+		devRoot = orgDevRoot
+		mountInfoPath = orgMountInfoPath
+	}()
+	devRoot = s.dev
+
+	mountInfo := filepath.Join(s.dev, "mountinfo")
+	assert.NoError(ioutil.WriteFile(mountInfo, []byte("36 35 7:3 / /mnt rw - ext4 /dev/loop3 rw\n"), 0644))
+	mountInfoPath = mountInfo
+
+	backingFile := filepath.Join(s.dev, "backing")
+	assert.NoError(ioutil.WriteFile(backingFile, nil, 0644))
+
+	// Detached
+	s.addDisk("loop0", map[string]string{"dev": "7:0"})
+	// Backing file exists
+	s.addDisk("loop1", map[string]string{"dev": "7:1", "loop/backing_file": backingFile})
+	// Backing file removed
+	loop2 := s.addDisk("loop2", map[string]string{"dev": "7:2", "loop/backing_file": backingFile + deletedSuffix})
+	// Mounted
+	s.addDisk("loop3", map[string]string{"dev": "7:3", "loop/backing_file": "/does/not/exist"})
+	// Backing file missing
+	loop4 := s.addDisk("loop4", map[string]string{"dev": "7:4", "loop/backing_file": "/does/not/exist"})
+	// Held
+	s.addDisk("loop5", map[string]string{"dev": "7:5", "loop/backing_file": "/does/not/exist", "holders/dm-0": ""})
+
+	s.addDisk("dm-0", map[string]string{"dev": "253:0", "slaves/loop5": ""})
+	s.addDisk("dm-1", map[string]string{"dev": "253:1", "holders/dm-2": ""})
+	dm2 := s.addDisk("dm-2", map[string]string{"dev": "253:2", "slaves/dm-1": ""})
+	s.addDisk("sda", map[string]string{"dev": "8:0"})
+
+	devices, err := FindStaleLoopDevices()
+	assert.NoError(err)
+	assert.Equal([]string{loop2, loop4}, devices)
+
+	devices, err = FindStaleDMDevices()
+	assert.NoError(err)
+	assert.Equal([]string{filepath.Join(s.dev, "dm-0"), dm2}, devices)
+
+	assert.NoError(ioutil.WriteFile(mountInfo, []byte("36 35 253:0 / /mnt rw - ext4 /dev/dm-0 rw\n"), 0644))
+	devices, err = FindStaleDMDevices()
+	assert.NoError(err)
+	assert.Equal([]string{dm2}, devices)
+
+	os.Remove(mountInfo)
+	_, err = FindStaleLoopDevices()
+	assert.Error(err)
+}
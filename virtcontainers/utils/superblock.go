@@ -0,0 +1,454 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ext2/3/4 superblock, see <fs/ext4/ext4.h>
+const (
+	extSuperblockOffset = 1024
+	extSuperblockSize   = 1024
+	extMagic            = 0xEF53
+
+	extBlocksCountLoOffset   = 0x04
+	extLogBlockSizeOffset    = 0x18
+	extMagicOffset           = 0x38
+	extStateOffset           = 0x3A
+	extRevLevelOffset        = 0x4C
+	extFeatureCompatOffset   = 0x5C
+	extFeatureIncompatOffset = 0x60
+	extFeatureRoCompatOffset = 0x64
+	extUUIDOffset            = 0x68
+	extLabelOffset           = 0x78
+	extLabelSize             = 16
+	extBlocksCountHiOffset   = 0x150
+
+	// s_state flags
+	extStateValid = 0x1
+	extStateError = 0x2
+
+	// s_feature_incompat flags
+	extFeatureIncompatRecover = 0x4
+	extFeatureIncompat64Bit   = 0x80
+)
+
+// extFeatures are the names of the ext2/3/4 feature flags, as used by
+// mke2fs and tune2fs, in the order dumpe2fs lists them.
+var extFeatures = []struct {
+	name  string
+	field func(sb *ExtSuperblock) uint32
+	flag  uint32
+}{
+	{"has_journal", extCompat, 0x4},
+	{"ext_attr", extCompat, 0x8},
+	{"resize_inode", extCompat, 0x10},
+	{"dir_index", extCompat, 0x20},
+	{"sparse_super2", extCompat, 0x200},
+	{"fast_commit", extCompat, 0x400},
+	{"stable_inodes", extCompat, 0x800},
+	{"orphan_file", extCompat, 0x1000},
+	{"filetype", extIncompat, 0x2},
+	{"needs_recovery", extIncompat, extFeatureIncompatRecover},
+	{"journal_dev", extIncompat, 0x8},
+	{"meta_bg", extIncompat, 0x10},
+	{"extent", extIncompat, 0x40},
+	{"64bit", extIncompat, extFeatureIncompat64Bit},
+	{"mmp", extIncompat, 0x100},
+	{"flex_bg", extIncompat, 0x200},
+	{"ea_inode", extIncompat, 0x400},
+	{"dirdata", extIncompat, 0x1000},
+	{"metadata_csum_seed", extIncompat, 0x2000},
+	{"large_dir", extIncompat, 0x4000},
+	{"inline_data", extIncompat, 0x8000},
+	{"encrypt", extIncompat, 0x10000},
+	{"casefold", extIncompat, 0x20000},
+	{"sparse_super", extRoCompat, 0x1},
+	{"large_file", extRoCompat, 0x2},
+	{"huge_file", extRoCompat, 0x8},
+	{"uninit_bg", extRoCompat, 0x10},
+	{"dir_nlink", extRoCompat, 0x20},
+	{"extra_isize", extRoCompat, 0x40},
+	{"quota", extRoCompat, 0x100},
+	{"bigalloc", extRoCompat, 0x200},
+	{"metadata_csum", extRoCompat, 0x400},
+	{"read-only", extRoCompat, 0x1000},
+	{"project", extRoCompat, 0x2000},
+	{"verity", extRoCompat, 0x8000},
+	{"orphan_present", extRoCompat, 0x10000},
+}
+
+// Feature flags known to ext3, a filesystem with other flags needs ext4,
+// as blkid decides.
+const (
+	extFeatureCompatHasJournal = 0x4
+	ext3FeatureIncompatSupp    = 0x2 | extFeatureIncompatRecover | 0x10
+	ext3FeatureRoCompatSupp    = 0x1 | 0x2 | 0x4
+)
+
+func extCompat(sb *ExtSuperblock) uint32   { return sb.FeatureCompat }
+func extIncompat(sb *ExtSuperblock) uint32 { return sb.FeatureIncompat }
+func extRoCompat(sb *ExtSuperblock) uint32 { return sb.FeatureRoCompat }
+
+// xfsMagic starts the XFS superblock, at the beginning of the device.
+var xfsMagic = []byte("XFSB")
+
+// XFS superblock, see <fs/xfs/libxfs/xfs_format.h>
+const (
+	xfsSuperblockSize = 512
+
+	xfsBlockSizeOffset = 4
+	xfsUUIDOffset      = 32
+	xfsLogStartOffset  = 48
+	xfsAGBlocksOffset  = 84
+	xfsLogBlocksOffset = 96
+	xfsLabelOffset     = 108
+	xfsLabelSize       = 12
+	xfsAGBlkLogOffset  = 124
+)
+
+// FAT boot sector, see <fs/fat/fat.h>
+const (
+	fatBootSectorSize  = 512
+	fatSignatureOffset = 510
+	fatSignature       = 0xAA55
+	fatLabelSize       = 11
+	fat16LabelOffset   = 0x2B
+	fat16FSTypeOffset  = 0x36
+	fat32LabelOffset   = 0x47
+	fat32FSTypeOffset  = 0x52
+	fatNoLabel         = "NO NAME"
+	fatFSTypePrefix    = "FAT"
+	fat32FSType        = "FAT32"
+)
+
+// uuidSize is the size of the filesystem UUIDs.
+const uuidSize = 16
+
+// ExtSuperblock holds the fields of an ext2/3/4 superblock describing the
+// layout and the features of the filesystem.
+type ExtSuperblock struct {
+	// Revision is the revision level, 0 for the original ext2 format
+	// without feature flags.
+	Revision uint32
+
+	// BlockSize is the size in bytes of the filesystem blocks.
+	BlockSize uint32
+
+	// BlocksCount is the number of blocks of the filesystem.
+	BlocksCount uint64
+
+	// State is the s_state bitmask, e.g. cleanly unmounted or with
+	// errors.
+	State uint16
+
+	// FeatureCompat, FeatureIncompat and FeatureRoCompat are the feature
+	// flags. Kernels must not mount filesystems with incompatible features
+	// they do not know, and only mount read-only those with read-only
+	// compatible features they do not know.
+	FeatureCompat   uint32
+	FeatureIncompat uint32
+	FeatureRoCompat uint32
+
+	uuid  []byte
+	label string
+}
+
+// readExtSuperblock reads the ext2/3/4 superblock of the filesystem starting
+// at offset in r. It returns nil and no error if there is no ext superblock.
+func readExtSuperblock(r io.ReaderAt, offset int64) (*ExtSuperblock, error) {
+	buf := make([]byte, extSuperblockSize)
+	if _, err := r.ReadAt(buf, offset+extSuperblockOffset); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	if le.Uint16(buf[extMagicOffset:]) != extMagic {
+		return nil, nil
+	}
+
+	sb := &ExtSuperblock{
+		Revision:        le.Uint32(buf[extRevLevelOffset:]),
+		BlockSize:       1024 << le.Uint32(buf[extLogBlockSizeOffset:]),
+		BlocksCount:     uint64(le.Uint32(buf[extBlocksCountLoOffset:])),
+		State:           le.Uint16(buf[extStateOffset:]),
+		FeatureCompat:   le.Uint32(buf[extFeatureCompatOffset:]),
+		FeatureIncompat: le.Uint32(buf[extFeatureIncompatOffset:]),
+		FeatureRoCompat: le.Uint32(buf[extFeatureRoCompatOffset:]),
+		uuid:            buf[extUUIDOffset : extUUIDOffset+uuidSize],
+		label:           cString(buf[extLabelOffset : extLabelOffset+extLabelSize]),
+	}
+
+	if sb.FeatureIncompat&extFeatureIncompat64Bit != 0 {
+		sb.BlocksCount |= uint64(le.Uint32(buf[extBlocksCountHiOffset:])) << 32
+	}
+
+	return sb, nil
+}
+
+// isXFS returns true if an XFS filesystem starts at offset in r.
+func isXFS(r io.ReaderAt, offset int64) (bool, error) {
+	buf := make([]byte, len(xfsMagic))
+	if _, err := r.ReadAt(buf, offset); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(buf, xfsMagic), nil
+}
+
+// formatUUID formats a binary UUID the way blkid does.
+func formatUUID(uuid []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
+
+// readFilesystemUUID returns the UUID of the ext2/3/4 or XFS filesystem
+// starting at offset in r.
+func readFilesystemUUID(r io.ReaderAt, offset int64) (string, error) {
+	sb, err := readExtSuperblock(r, offset)
+	if err != nil {
+		return "", err
+	}
+
+	if sb != nil {
+		return formatUUID(sb.uuid), nil
+	}
+
+	xfs, err := isXFS(r, offset)
+	if err != nil {
+		return "", err
+	}
+
+	if !xfs {
+		return "", fmt.Errorf("No supported filesystem found")
+	}
+
+	uuid := make([]byte, uuidSize)
+	if _, err := r.ReadAt(uuid, offset+xfsUUIDOffset); err != nil {
+		return "", err
+	}
+
+	return formatUUID(uuid), nil
+}
+
+// cString returns the NUL terminated string in b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+// readFATLabel returns the label of the FAT filesystem starting at offset
+// in r, as found in its boot sector, and whether there is a FAT filesystem.
+func readFATLabel(r io.ReaderAt, offset int64) (string, bool, error) {
+	buf := make([]byte, fatBootSectorSize)
+	if _, err := r.ReadAt(buf, offset); err == io.EOF {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	if binary.LittleEndian.Uint16(buf[fatSignatureOffset:]) != fatSignature {
+		return "", false, nil
+	}
+
+	var label string
+	switch {
+	case bytes.HasPrefix(buf[fat32FSTypeOffset:], []byte(fat32FSType)):
+		label = string(buf[fat32LabelOffset : fat32LabelOffset+fatLabelSize])
+	case bytes.HasPrefix(buf[fat16FSTypeOffset:], []byte(fatFSTypePrefix)):
+		label = string(buf[fat16LabelOffset : fat16LabelOffset+fatLabelSize])
+	default:
+		return "", false, nil
+	}
+
+	label = strings.TrimRight(label, " \x00")
+	if label == fatNoLabel {
+		label = ""
+	}
+
+	return label, true, nil
+}
+
+// readFilesystemLabel returns the label of the ext2/3/4, XFS or FAT
+// filesystem starting at offset in r, or "" if it has none.
+func readFilesystemLabel(r io.ReaderAt, offset int64) (string, error) {
+	sb, err := readExtSuperblock(r, offset)
+	if err != nil {
+		return "", err
+	}
+
+	if sb != nil {
+		return sb.label, nil
+	}
+
+	xfs, err := isXFS(r, offset)
+	if err != nil {
+		return "", err
+	}
+
+	if xfs {
+		label := make([]byte, xfsLabelSize)
+		if _, err := r.ReadAt(label, offset+xfsLabelOffset); err != nil {
+			return "", err
+		}
+
+		return cString(label), nil
+	}
+
+	label, fat, err := readFATLabel(r, offset)
+	if err != nil {
+		return "", err
+	}
+
+	if !fat {
+		return "", fmt.Errorf("No supported filesystem found")
+	}
+
+	return label, nil
+}
+
+// probeFSType returns the type of the filesystem starting at offset in r,
+// as blkid names it, among ext2, ext3, ext4, xfs and vfat, or "" if there
+// is no such filesystem.
+func probeFSType(r io.ReaderAt, offset int64) (string, error) {
+	sb, err := readExtSuperblock(r, offset)
+	if err != nil {
+		return "", err
+	}
+
+	if sb != nil {
+		switch {
+		case sb.FeatureIncompat&^ext3FeatureIncompatSupp != 0,
+			sb.FeatureRoCompat&^ext3FeatureRoCompatSupp != 0:
+			return "ext4", nil
+		case sb.FeatureCompat&extFeatureCompatHasJournal != 0:
+			return "ext3", nil
+		default:
+			return "ext2", nil
+		}
+	}
+
+	xfs, err := isXFS(r, offset)
+	if err != nil {
+		return "", err
+	}
+
+	if xfs {
+		return "xfs", nil
+	}
+
+	_, fat, err := readFATLabel(r, offset)
+	if err != nil {
+		return "", err
+	}
+
+	if fat {
+		return "vfat", nil
+	}
+
+	return "", nil
+}
+
+// NeedsRecovery returns true if the filesystem on disk was not cleanly
+// unmounted or has errors, and should be checked before being mounted. It
+// only reads the superblock of ext2/3/4 filesystems, and the head of the
+// log of XFS filesystems, which records their state, which is cheap but
+// does not replace fsck. ErrRecoveryStateUnknown is returned for XFS
+// filesystems with an external log.
+func NeedsRecovery(disk string) (bool, error) {
+	f, err := os.Open(disk)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	sb, err := readExtSuperblock(f, 0)
+	if err != nil {
+		return false, err
+	}
+
+	if sb != nil {
+		return sb.FeatureIncompat&extFeatureIncompatRecover != 0 ||
+			sb.State&extStateValid == 0 ||
+			sb.State&extStateError != 0, nil
+	}
+
+	xfs, err := isXFS(f, 0)
+	if err != nil {
+		return false, err
+	}
+
+	if xfs {
+		dirty, err := xfsLogDirty(f, 0)
+		if err != nil && err != ErrRecoveryStateUnknown {
+			return false, fmt.Errorf("Could not check the log of XFS filesystem on %s: %v", disk, err)
+		}
+		return dirty, err
+	}
+
+	return false, fmt.Errorf("No supported filesystem found on %s", disk)
+}
+
+// HasFeature returns true if the feature name, as named by mke2fs, e.g.
+// "64bit" or "metadata_csum", is enabled.
+func (sb *ExtSuperblock) HasFeature(name string) bool {
+	for _, f := range extFeatures {
+		if f.name == name {
+			return f.field(sb)&f.flag != 0
+		}
+	}
+
+	return false
+}
+
+// Features returns the names of the enabled features, in the order
+// dumpe2fs lists them. The features unknown to this package are left
+// out.
+func (sb *ExtSuperblock) Features() []string {
+	var features []string
+	for _, f := range extFeatures {
+		if f.field(sb)&f.flag != 0 {
+			features = append(features, f.name)
+		}
+	}
+
+	return features
+}
+
+// ExtFeatures returns the superblock fields describing the ext2/3/4
+// filesystem on disk, in particular its feature flags, e.g. to check it can
+// be mounted by a given kernel. Only the superblock is read, the
+// filesystem is not checked.
+func ExtFeatures(disk string) (*ExtSuperblock, error) {
+	f, err := os.Open(disk)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sb, err := readExtSuperblock(f, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if sb == nil {
+		return nil, fmt.Errorf("No ext2/3/4 filesystem found on %s", disk)
+	}
+
+	return sb, nil
+}
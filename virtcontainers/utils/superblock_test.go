@@ -0,0 +1,338 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testExtSuperblock describes the ext superblock fields written by
+// writeTestImage.
+type testExtSuperblock struct {
+	state           uint16
+	featureIncompat uint32
+}
+
+// writeTestImage creates a 1MiB image file, with the ext superblock sb at
+// offset if sb is not nil, and returns its path.
+func writeTestImage(t *testing.T, offset int64, sb *testExtSuperblock) string {
+	f, err := ioutil.TempFile("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.Truncate(offset + 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	if sb != nil {
+		buf := make([]byte, extSuperblockSize)
+		binary.LittleEndian.PutUint16(buf[extMagicOffset:], extMagic)
+		binary.LittleEndian.PutUint16(buf[extStateOffset:], sb.state)
+		binary.LittleEndian.PutUint32(buf[extFeatureIncompatOffset:], sb.featureIncompat)
+
+		if _, err := f.WriteAt(buf, offset+extSuperblockOffset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return f.Name()
+}
+
+func TestNeedsRecovery(t *testing.T) {
+	assert := assert.New(t)
+
+	// extents, flex_bg, 64bit...
+	const features = 0x2c2
+
+	tests := []struct {
+		sb       testExtSuperblock
+		expected bool
+	}{
+		{testExtSuperblock{extStateValid, features}, false},
+		{testExtSuperblock{extStateValid, features | extFeatureIncompatRecover}, true},
+		{testExtSuperblock{0, features}, true},
+		{testExtSuperblock{extStateValid | extStateError, features}, true},
+	}
+
+	for i, test := range tests {
+		image := writeTestImage(t, 0, &test.sb)
+		defer os.Remove(image)
+
+		dirty, err := NeedsRecovery(image)
+		assert.NoError(err, "test %d", i)
+		assert.Equal(test.expected, dirty, "test %d", i)
+	}
+
+	// No filesystem
+	image := writeTestImage(t, 0, nil)
+	defer os.Remove(image)
+	_, err := NeedsRecovery(image)
+	assert.Error(err)
+
+	// XFS
+	err = ioutil.WriteFile(image, testXFSImage(testXFSLogStart, testXFSRecord{0, 1, true}), 0644)
+	assert.NoError(err)
+	dirty, err := NeedsRecovery(image)
+	assert.NoError(err)
+	assert.False(dirty)
+
+	err = ioutil.WriteFile(image, testXFSImage(testXFSLogStart, testXFSRecord{0, 1, false}), 0644)
+	assert.NoError(err)
+	dirty, err = NeedsRecovery(image)
+	assert.NoError(err)
+	assert.True(dirty)
+
+	err = ioutil.WriteFile(image, testXFSImage(0), 0644)
+	assert.NoError(err)
+	_, err = NeedsRecovery(image)
+	assert.Equal(ErrRecoveryStateUnknown, err)
+
+	err = ioutil.WriteFile(image, append(xfsMagic, make([]byte, 4096)...), 0644)
+	assert.NoError(err)
+	_, err = NeedsRecovery(image)
+	assert.Error(err)
+
+	// Too small
+	err = ioutil.WriteFile(image, []byte("small"), 0644)
+	assert.NoError(err)
+	_, err = NeedsRecovery(image)
+	assert.Error(err)
+
+	_, err = NeedsRecovery("/does/not/exist")
+	assert.Error(err)
+}
+
+func TestReadFilesystemUUID(t *testing.T) {
+	assert := assert.New(t)
+
+	uuid := []byte{0x81, 0x2c, 0x4d, 0x2e, 0x4a, 0x1b, 0x4b, 0x34, 0x9a, 0x2f, 0x43, 0x8c, 0x43, 0x40, 0x1e, 0xbb}
+	const expected = "812c4d2e-4a1b-4b34-9a2f-438c43401ebb"
+
+	for _, offset := range []int64{0, 1 << 20} {
+		image := writeTestImage(t, offset, &testExtSuperblock{extStateValid, 0})
+		defer os.Remove(image)
+
+		f, err := os.OpenFile(image, os.O_RDWR, 0)
+		assert.NoError(err)
+		defer f.Close()
+
+		_, err = f.WriteAt(uuid, offset+extSuperblockOffset+extUUIDOffset)
+		assert.NoError(err)
+
+		got, err := readFilesystemUUID(f, offset)
+		assert.NoError(err)
+		assert.Equal(expected, got)
+	}
+
+	image := writeTestImage(t, 0, nil)
+	defer os.Remove(image)
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	assert.NoError(err)
+	defer f.Close()
+
+	_, err = readFilesystemUUID(f, 0)
+	assert.Error(err)
+
+	// XFS
+	_, err = f.WriteAt(xfsMagic, 0)
+	assert.NoError(err)
+	_, err = f.WriteAt(uuid, xfsUUIDOffset)
+	assert.NoError(err)
+
+	got, err := readFilesystemUUID(f, 0)
+	assert.NoError(err)
+	assert.Equal(expected, got)
+}
+
+func TestReadFilesystemLabel(t *testing.T) {
+	assert := assert.New(t)
+
+	image := writeTestImage(t, 0, nil)
+	defer os.Remove(image)
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	assert.NoError(err)
+	defer f.Close()
+
+	_, err = readFilesystemLabel(f, 0)
+	assert.Error(err)
+
+	writeAt := func(b []byte, offset int64) {
+		_, err := f.WriteAt(b, offset)
+		assert.NoError(err)
+	}
+
+	fatBootSector := func(label string, fstypeOffset, labelOffset int, fstype string) []byte {
+		buf := make([]byte, fatBootSectorSize)
+		binary.LittleEndian.PutUint16(buf[fatSignatureOffset:], fatSignature)
+		copy(buf[fstypeOffset:], fstype)
+		copy(buf[labelOffset:labelOffset+fatLabelSize], []byte(label + "           ")[:fatLabelSize])
+		return buf
+	}
+
+	tests := []struct {
+		bootSector []byte
+		label      string
+	}{
+		{fatBootSector("EFI", fat16FSTypeOffset, fat16LabelOffset, "FAT16   "), "EFI"},
+		{fatBootSector("CONFIG 2", fat16FSTypeOffset, fat16LabelOffset, "FAT12   "), "CONFIG 2"},
+		{fatBootSector("BOOT", fat32FSTypeOffset, fat32LabelOffset, "FAT32   "), "BOOT"},
+		{fatBootSector(fatNoLabel, fat32FSTypeOffset, fat32LabelOffset, "FAT32   "), ""},
+	}
+
+	for _, test := range tests {
+		writeAt(test.bootSector, 0)
+		label, err := readFilesystemLabel(f, 0)
+		assert.NoError(err)
+		assert.Equal(test.label, label)
+	}
+
+	// No FAT type
+	writeAt(fatBootSector("BOOT", fat32FSTypeOffset, fat32LabelOffset, "NTFS    "), 0)
+	_, err = readFilesystemLabel(f, 0)
+	assert.Error(err)
+
+	// XFS
+	writeAt(make([]byte, fatBootSectorSize), 0)
+	writeAt(xfsMagic, 0)
+	writeAt([]byte("scratch\x00"), xfsLabelOffset)
+	label, err := readFilesystemLabel(f, 0)
+	assert.NoError(err)
+	assert.Equal("scratch", label)
+
+	// ext4, with a label of the maximum size
+	writeAt(make([]byte, fatBootSectorSize), 0)
+	ext := writeTestImage(t, 0, &testExtSuperblock{extStateValid, 0})
+	defer os.Remove(ext)
+	extFile, err := os.OpenFile(ext, os.O_RDWR, 0)
+	assert.NoError(err)
+	defer extFile.Close()
+
+	label, err = readFilesystemLabel(extFile, 0)
+	assert.NoError(err)
+	assert.Equal("", label)
+
+	_, err = extFile.WriteAt([]byte("0123456789abcdef"), extSuperblockOffset+extLabelOffset)
+	assert.NoError(err)
+	label, err = readFilesystemLabel(extFile, 0)
+	assert.NoError(err)
+	assert.Equal("0123456789abcdef", label)
+}
+
+func TestExtFeatures(t *testing.T) {
+	assert := assert.New(t)
+
+	// extents, 64bit, flex_bg
+	image := writeTestImage(t, 0, &testExtSuperblock{extStateValid, 0x2c0})
+	defer os.Remove(image)
+
+	sb, err := ExtFeatures(image)
+	assert.NoError(err)
+	assert.Equal(uint16(extStateValid), sb.State)
+	assert.Equal([]string{"extent", "64bit", "flex_bg"}, sb.Features())
+	assert.True(sb.HasFeature("64bit"))
+	assert.False(sb.HasFeature("metadata_csum"))
+	assert.False(sb.HasFeature("does-not-exist"))
+
+	noFS := writeTestImage(t, 0, nil)
+	defer os.Remove(noFS)
+	_, err = ExtFeatures(noFS)
+	assert.Error(err)
+
+	_, err = ExtFeatures(noFS + "-does-not-exist")
+	assert.Error(err)
+}
+
+func TestExtFeaturesMkfs(t *testing.T) {
+	assert := assert.New(t)
+
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	f, err := ioutil.TempFile("", "ext4")
+	assert.NoError(err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", "-b", "4096", "-O", "64bit,metadata_csum,^has_journal", f.Name(), "16M").CombinedOutput()
+	if !assert.NoError(err, string(out)) {
+		return
+	}
+
+	sb, err := ExtFeatures(f.Name())
+	assert.NoError(err)
+	assert.Equal(uint32(1), sb.Revision)
+	assert.Equal(uint32(4096), sb.BlockSize)
+	assert.Equal(uint64(4096), sb.BlocksCount)
+	assert.True(sb.HasFeature("64bit"))
+	assert.True(sb.HasFeature("metadata_csum"))
+	assert.True(sb.HasFeature("extent"))
+	assert.False(sb.HasFeature("has_journal"))
+	assert.False(sb.HasFeature("needs_recovery"))
+}
+
+func TestProbeFSType(t *testing.T) {
+	assert := assert.New(t)
+
+	const offset = 1 << 20
+
+	for _, test := range []struct {
+		featureIncompat uint32
+		fstype          string
+	}{
+		{0, "ext2"},
+		{extFeatureIncompatRecover, "ext2"},
+		// extents, 64bit, flex_bg
+		{0x2c0, "ext4"},
+	} {
+		image := writeTestImage(t, offset, &testExtSuperblock{extStateValid, test.featureIncompat})
+		defer os.Remove(image)
+
+		f, err := os.Open(image)
+		assert.NoError(err)
+		defer f.Close()
+
+		fstype, err := probeFSType(f, offset)
+		assert.NoError(err)
+		assert.Equal(test.fstype, fstype)
+
+		fstype, err = probeFSType(f, 0)
+		assert.NoError(err)
+		assert.Empty(fstype)
+	}
+
+	image := writeTestImage(t, 0, nil)
+	defer os.Remove(image)
+
+	f, err := os.OpenFile(image, os.O_RDWR, 0)
+	assert.NoError(err)
+	defer f.Close()
+
+	_, err = f.WriteAt(xfsMagic, offset)
+	assert.NoError(err)
+	fstype, err := probeFSType(f, offset)
+	assert.NoError(err)
+	assert.Equal("xfs", fstype)
+
+	buf := make([]byte, fatBootSectorSize)
+	binary.LittleEndian.PutUint16(buf[fatSignatureOffset:], fatSignature)
+	copy(buf[fat32FSTypeOffset:], fat32FSType)
+	_, err = f.WriteAt(buf, 2*offset)
+	assert.NoError(err)
+	fstype, err = probeFSType(f, 2*offset)
+	assert.NoError(err)
+	assert.Equal("vfat", fstype)
+}
@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -105,6 +106,61 @@ func WriteToFile(path string, data []byte) error {
 	return nil
 }
 
+// AtomicWriteFile writes data to path, so that path holds either its
+// previous content or all of data, even after a crash. data is written to
+// a temporary file in the directory of path, with permissions perm
+// regardless of the umask, which is synced and renamed over path before
+// the directory itself is synced.
+func AtomicWriteFile(path string, data []byte, perm os.FileMode) (err error) {
+	if path == "" {
+		return errors.New("empty path")
+	}
+
+	dir := filepath.Dir(path)
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
 //CalculateMilliCPUs converts CPU quota and period to milli-CPUs
 func CalculateMilliCPUs(quota int64, period uint64) uint32 {
 
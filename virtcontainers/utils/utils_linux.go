@@ -6,13 +6,20 @@
 package utils
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
@@ -22,22 +29,208 @@ const ioctlVhostVsockSetGuestCid = 0x4008AF60
 
 var ioctlFunc = Ioctl
 
+var scanBackoffSleep = time.Sleep
+
+// contextIDDeadlineCheck is how many probes are done between two checks
+// of the deadline of a scan.
+const contextIDDeadlineCheck = 1024
+
 // maxUInt represents the maximum valid value for the context ID.
 // The upper 32 bits of the CID are reserved and zeroed.
 // See http://stefanha.github.io/virtio/
 var maxUInt uint64 = 1<<32 - 1
 
+// context IDs 0x0, 0x1 and 0x2 are reserved, 0x3 is the first context ID usable.
+const firstContextID uint64 = 0x3
+
+// Ioctl issues the request ioctl on fd. On failure the returned
+// *os.SyscallError wraps the syscall.Errno, see ioctlErrno.
 func Ioctl(fd uintptr, request, data uintptr) error {
 	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, request, data); errno != 0 {
-		//uintptr(request)
-		//uintptr(unsafe.Pointer(&arg1)),
-		//); errno != 0 {
-		return os.NewSyscallError("ioctl", fmt.Errorf("%d", int(errno)))
+		return os.NewSyscallError("ioctl", errno)
 	}
 
 	return nil
 }
 
+// ioctlErrno returns the errno of an error returned by Ioctl, or 0 if err
+// does not carry one.
+func ioctlErrno(err error) syscall.Errno {
+	if serr, ok := err.(*os.SyscallError); ok {
+		if errno, ok := serr.Err.(syscall.Errno); ok {
+			return errno
+		}
+	}
+
+	return 0
+}
+
+// CanIoctl returns an error if the ioctl system call looks blocked, e.g.
+// by a seccomp profile or a missing capability, which otherwise makes
+// FindContextID and the block device helpers fail with obscure errors. A
+// harmless TCGETS is issued on /dev/null, for which any error but ENOTTY is
+// unexpected. This is best-effort: a profile filtering on the ioctl request
+// might still block the ones actually needed.
+func CanIoctl() error {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var termios unix.Termios
+	err = ioctlFunc(f.Fd(), unix.TCGETS, uintptr(unsafe.Pointer(&termios)))
+
+	switch errno := ioctlErrno(err); {
+	case err == nil, errno == syscall.ENOTTY:
+		return nil
+	case errno == syscall.EPERM, errno == syscall.EACCES, errno == syscall.ENOSYS:
+		return fmt.Errorf("The ioctl system call is blocked (%v), check the seccomp profile and the capabilities of the runtime allow it", err)
+	default:
+		return fmt.Errorf("Could not probe the ioctl system call: %v", err)
+	}
+}
+
+// Tracer starts tracing spans. It lets callers plug their own tracing
+// library in, without this package depending on it.
+type Tracer interface {
+	StartSpan(name string) Span
+}
+
+// Span is a traced operation, started by a Tracer.
+type Span interface {
+	End()
+}
+
+// ContextIDTracer, when set, traces every context ID allocation.
+var ContextIDTracer Tracer
+
+// ContextIDExhaustedError is returned when no context ID is available.
+// On a saturated host this can happen over and over, callers that log
+// it should rate limit, for instance by only logging again once some
+// time has passed since the Time of the last error they logged.
+type ContextIDExhaustedError struct {
+	// Time is when the scan gave up.
+	Time time.Time
+
+	// Attempts is the number of context IDs that were tried.
+	Attempts uint64
+}
+
+func (e *ContextIDExhaustedError) Error() string {
+	return "Could not get a unique context ID for the vsock"
+}
+
+// ContextIDOptions describes how FindContextIDWithOptions looks for an
+// available context ID.
+type ContextIDOptions struct {
+	// RandomStart makes the scan begin at a random context ID, which is
+	// the default. When false the scan begins at the first usable context
+	// ID and only goes up, so context IDs are handed out densely and
+	// predictably. That is handy for reproducible setups, but it gives up
+	// the DoS resistance described in FindContextID.
+	RandomStart bool
+
+	// Workers splits the context ID space in as many sub-ranges, and
+	// Worker selects the one the scan starts from. Concurrent workers
+	// using different sub-ranges do not race for the same context IDs,
+	// while each of them can still get any context ID once its own
+	// sub-range is exhausted. 0 or 1 worker means the whole space.
+	Workers int
+	Worker  int
+
+	// MaxContextID caps the context IDs that can be allocated, to
+	// partition the context ID space between several allocators, e.g.
+	// nested runtimes. 0 means no cap, and values above the largest
+	// valid context ID are clamped to it. Worker sub-ranges are carved
+	// out of the capped space.
+	MaxContextID uint64
+
+	// Registry, when set, gets the allocated context ID registered with
+	// Name, for observability only.
+	Registry *ContextIDRegistry
+	Name     string
+
+	// BackoffInterval and BackoffDelay make the scan sleep BackoffDelay
+	// every BackoffInterval probes. On hosts where many processes scan the
+	// context ID space at the same time, tight ioctl loops contend for the
+	// same kernel lock, and yielding from time to time eases it at the
+	// cost of a slower scan when plenty of context IDs are in use. The
+	// backoff is disabled when either of them is 0, which is the default.
+	BackoffInterval int
+	BackoffDelay    time.Duration
+
+	// HintFile is the path of a file listing context IDs, one per line,
+	// that are likely free, e.g. as maintained by a cluster controller.
+	// They are tried first, in order, before scanning. Entries that are
+	// invalid, beyond the maximum context ID or in use are skipped, and
+	// so is the whole file if it cannot be read. Empty means no hints.
+	HintFile string
+}
+
+// maxContextID returns the largest context ID that can be allocated.
+func (opts ContextIDOptions) maxContextID() (uint64, error) {
+	if opts.MaxContextID == 0 || opts.MaxContextID > maxUInt {
+		return maxUInt, nil
+	}
+
+	if opts.MaxContextID < firstContextID {
+		return 0, fmt.Errorf("Invalid maximum context ID %d, it must be at least %d", opts.MaxContextID, firstContextID)
+	}
+
+	return opts.MaxContextID, nil
+}
+
+// backoff sleeps if the scan described by opts must yield after attempts
+// probes.
+func (opts ContextIDOptions) backoff(attempts uint64) {
+	if opts.BackoffInterval <= 0 || opts.BackoffDelay <= 0 {
+		return
+	}
+
+	if attempts%uint64(opts.BackoffInterval) == 0 {
+		scanBackoffSleep(opts.BackoffDelay)
+	}
+}
+
+// hintedContextIDs returns the valid context IDs listed in the hint file of
+// opts, up to max.
+func (opts ContextIDOptions) hintedContextIDs(max uint64) []uint64 {
+	if opts.HintFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(opts.HintFile)
+	if err != nil {
+		return nil
+	}
+
+	var cids []uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		cid, err := strconv.ParseUint(strings.TrimSpace(line), 10, 64)
+		if err != nil || cid < firstContextID || cid > max {
+			continue
+		}
+		cids = append(cids, cid)
+	}
+
+	return cids
+}
+
+// register registers cid in the registry of opts, if any.
+func (opts ContextIDOptions) register(cid uint64) {
+	if opts.Registry != nil {
+		opts.Registry.Register(cid, opts.Name)
+	}
+}
+
+// DefaultContextIDOptions returns the options used by FindContextID.
+func DefaultContextIDOptions() ContextIDOptions {
+	return ContextIDOptions{
+		RandomStart: true,
+	}
+}
+
 // FindContextID finds a unique context ID by generating a random number between 3 and max unsigned int (maxUint).
 // Using the ioctl VHOST_VSOCK_SET_GUEST_CID, findContextID asks to the kernel if the given
 // context ID (N) is available, when the context ID is not available, incrementing by 1 findContextID
@@ -47,20 +240,90 @@ func Ioctl(fd uintptr, request, data uintptr) error {
 // On success vhost file and a context ID greater or equal than 3 are returned, otherwise 0 and an error are returned.
 // vhost file can be used to send vhost file decriptor to QEMU. It's the caller's responsibility to
 // close vhost file descriptor.
+// vhost file is close-on-exec: QEMU only inherits it when passed through exec.Cmd.ExtraFiles, or
+// once ClearCloseOnExec is called on it.
 //
 // Benefits of using random context IDs:
 // - Reduce the probability of a *DoS attack*, since other processes don't know whatis the initial context ID
 //   used by findContextID to find a context ID available
 //
 func FindContextID() (*os.File, uint64, error) {
-	// context IDs 0x0, 0x1 and 0x2 are reserved, 0x3 is the first context ID usable.
-	var firstContextID uint64 = 0x3
-	var contextID = firstContextID
+	return FindContextIDWithOptions(DefaultContextIDOptions())
+}
+
+// contextIDStart returns the context ID the scan described by opts starts
+// from, max being the largest context ID that can be allocated.
+func contextIDStart(opts ContextIDOptions, max uint64) (uint64, error) {
+	first, last := firstContextID, max
+
+	if opts.Workers > 1 {
+		if opts.Worker < 0 || opts.Worker >= opts.Workers {
+			return 0, fmt.Errorf("Invalid worker %d, expected a value between 0 and %d", opts.Worker, opts.Workers-1)
+		}
+
+		// The last worker also gets the remainder.
+		width := (max - firstContextID + 1) / uint64(opts.Workers)
+		if width == 0 {
+			return 0, fmt.Errorf("Too many workers (%d) for %d context IDs", opts.Workers, max-firstContextID+1)
+		}
+		first = firstContextID + uint64(opts.Worker)*width
+		if opts.Worker < opts.Workers-1 {
+			last = first + width - 1
+		}
+	}
+
+	if !opts.RandomStart {
+		return first, nil
+	}
 
 	// Generate a random number
-	n, err := rand.Int(rand.Reader, big.NewInt(int64(maxUInt)))
-	if err == nil && n.Int64() >= int64(firstContextID) {
-		contextID = uint64(n.Int64())
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(last-first+1)))
+	if err != nil {
+		return first, nil
+	}
+
+	return first + n.Uint64(), nil
+}
+
+// FindContextIDWithOptions works like FindContextID but lets the caller
+// choose how the scan is performed, see ContextIDOptions. When
+// opts.RandomStart is false the scan starts at the beginning of the worker
+// sub-range, 3 by default, and goes up to the maximum context ID. The
+// downward phase only happens when there are context IDs below the start.
+func FindContextIDWithOptions(opts ContextIDOptions) (*os.File, uint64, error) {
+	return findContextID(context.Background(), opts)
+}
+
+// FindContextIDDeadline works like FindContextID but gives up once deadline
+// is reached, e.g. to fit in the time left to create a sandbox. The deadline
+// is checked every contextIDDeadlineCheck probes so that it does not slow
+// the scan down. On timeout the vhost file is closed and the returned error
+// wraps context.DeadlineExceeded.
+func FindContextIDDeadline(deadline time.Time) (*os.File, uint64, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	return findContextID(ctx, DefaultContextIDOptions())
+}
+
+func findContextID(ctx context.Context, opts ContextIDOptions) (*os.File, uint64, error) {
+	if ContextIDTracer != nil {
+		span := ContextIDTracer.StartSpan("FindContextID")
+		defer span.End()
+	}
+
+	max, err := opts.maxContextID()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	contextID, err := contextIDStart(opts, max)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "Could not get a context ID")
 	}
 
 	// Open vhost-vsock device to check what context ID is available.
@@ -71,20 +334,221 @@ func FindContextID() (*os.File, uint64, error) {
 		return nil, 0, err
 	}
 
-	// Looking for the first available context ID.
-	for cid := contextID; cid <= maxUInt; cid++ {
+	var attempts uint64
+
+	// expired closes the vhost file and returns the error of ctx once it
+	// is done.
+	expired := func() error {
+		if attempts%contextIDDeadlineCheck != 0 || ctx.Err() == nil {
+			return nil
+		}
+		vsockFd.Close()
+		return errors.Wrapf(ctx.Err(), "Could not get a context ID after %d attempts", attempts)
+	}
+
+	for _, cid := range opts.hintedContextIDs(max) {
+		attempts++
 		if err := ioctlFunc(vsockFd.Fd(), ioctlVhostVsockSetGuestCid, uintptr(unsafe.Pointer(&cid))); err == nil {
+			opts.register(cid)
 			return vsockFd, cid, nil
 		}
 	}
 
-	// Last chance to get a free context ID.
-	for cid := contextID - 1; cid >= firstContextID; cid-- {
+	// Looking for the first available context ID.
+	for cid := contextID; cid <= max; cid++ {
+		attempts++
 		if err := ioctlFunc(vsockFd.Fd(), ioctlVhostVsockSetGuestCid, uintptr(unsafe.Pointer(&cid))); err == nil {
+			opts.register(cid)
 			return vsockFd, cid, nil
 		}
+		opts.backoff(attempts)
+		if err := expired(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// Last chance to get a free context ID.
+	if contextID > firstContextID {
+		for cid := contextID - 1; cid >= firstContextID; cid-- {
+			attempts++
+			if err := ioctlFunc(vsockFd.Fd(), ioctlVhostVsockSetGuestCid, uintptr(unsafe.Pointer(&cid))); err == nil {
+				opts.register(cid)
+				return vsockFd, cid, nil
+			}
+			opts.backoff(attempts)
+			if err := expired(); err != nil {
+				return nil, 0, err
+			}
+		}
 	}
 
 	vsockFd.Close()
-	return nil, 0, fmt.Errorf("Could not get a unique context ID for the vsock")
+	return nil, 0, &ContextIDExhaustedError{
+		Time:     time.Now(),
+		Attempts: attempts,
+	}
+}
+
+// CountFreeContextIDs estimates how many context IDs are free by probing
+// sampleSize random context IDs, it returns how many of them were available
+// and how many were probed. This is a sampled estimate of the pressure on
+// the context ID space, not an exact count.
+// Every successful probe moves the context ID held by a single vhost file
+// descriptor, which is closed before returning, so no context ID is held
+// once CountFreeContextIDs returns.
+func CountFreeContextIDs(sampleSize int) (int, int, error) {
+	if sampleSize <= 0 {
+		return 0, 0, fmt.Errorf("Sample size must be greater than 0")
+	}
+
+	vsockFd, err := os.OpenFile(VHostVSockDevicePath, syscall.O_RDWR, 0666)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer vsockFd.Close()
+
+	var free, sampled int
+	for sampled < sampleSize {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(maxUInt-firstContextID+1)))
+		if err != nil {
+			return free, sampled, err
+		}
+
+		cid := n.Uint64() + firstContextID
+		sampled++
+		if err := ioctlFunc(vsockFd.Fd(), ioctlVhostVsockSetGuestCid, uintptr(unsafe.Pointer(&cid))); err == nil {
+			free++
+		}
+	}
+
+	return free, sampled, nil
+}
+
+// ContextIDRange is the range of context IDs from First to Last, both
+// included.
+type ContextIDRange struct {
+	First uint64
+	Last  uint64
+}
+
+// AuditHeldContextIDs probes every context ID of ranges and returns, in
+// order, those already held by a vhost-vsock device, e.g. to investigate
+// which processes put pressure on the context ID space. Probing is slow,
+// one ioctl per context ID, hence the explicit ranges, and it stops with
+// the error of ctx once ctx is done, ctx being checked every
+// contextIDDeadlineCheck probes. The free context IDs are moved through a
+// single vhost file descriptor, closed before returning, so no context ID
+// is held once AuditHeldContextIDs returns.
+func AuditHeldContextIDs(ctx context.Context, ranges []ContextIDRange) ([]uint64, error) {
+	if ctx == nil {
+		return nil, fmt.Errorf("A context must be specified")
+	}
+
+	for _, r := range ranges {
+		if r.First < firstContextID || r.First > r.Last || r.Last > maxUInt {
+			return nil, fmt.Errorf("Invalid context ID range [%d, %d], expected a range within [%d, %d]", r.First, r.Last, firstContextID, maxUInt)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "Could not audit context IDs")
+	}
+
+	vsockFd, err := os.OpenFile(VHostVSockDevicePath, syscall.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	// Closing the file descriptor releases the last free context ID.
+	defer vsockFd.Close()
+
+	var held []uint64
+	var probes uint64
+
+	for _, r := range ranges {
+		for cid := r.First; cid <= r.Last; cid++ {
+			probes++
+			err := ioctlFunc(vsockFd.Fd(), ioctlVhostVsockSetGuestCid, uintptr(unsafe.Pointer(&cid)))
+			if err != nil {
+				if ioctlErrno(err) != syscall.EADDRINUSE {
+					return nil, errors.Wrapf(err, "Could not probe context ID %d", cid)
+				}
+				held = append(held, cid)
+			}
+
+			if probes%contextIDDeadlineCheck == 0 && ctx.Err() != nil {
+				return nil, errors.Wrapf(ctx.Err(), "Could not audit context IDs after %d probes", probes)
+			}
+		}
+	}
+
+	return held, nil
+}
+
+// IsContextIDAvailable returns true if no vhost-vsock device holds cid.
+// cid is only held while being checked, so it may be taken by someone else
+// by the time IsContextIDAvailable returns.
+func IsContextIDAvailable(cid uint64) (bool, error) {
+	if cid < firstContextID || cid > maxUInt {
+		return false, fmt.Errorf("Invalid context ID %d", cid)
+	}
+
+	vsockFd, err := os.OpenFile(VHostVSockDevicePath, syscall.O_RDWR, 0666)
+	if err != nil {
+		return false, err
+	}
+	// Closing the file descriptor releases cid.
+	defer vsockFd.Close()
+
+	err = ioctlFunc(vsockFd.Fd(), ioctlVhostVsockSetGuestCid, uintptr(unsafe.Pointer(&cid)))
+	if err == nil {
+		return true, nil
+	}
+
+	if ioctlErrno(err) == syscall.EADDRINUSE {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// WaitForContextIDFree checks about every interval whether cid is available,
+// until it is or ctx is done, see RetryWithBackoff. cid is not held once
+// WaitForContextIDFree returns.
+func WaitForContextIDFree(ctx context.Context, cid uint64, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid interval %v", interval)
+	}
+
+	err := RetryWithBackoff(ctx, interval, interval, func() (bool, error) {
+		return IsContextIDAvailable(cid)
+	})
+	if err != nil && err == ctx.Err() {
+		return fmt.Errorf("Context ID %d still in use: %v", cid, err)
+	}
+
+	return err
+}
+
+// ContextIDEncoder encodes a context ID in the wire format a VMM expects.
+type ContextIDEncoder func(cid uint64) []byte
+
+// FindContextIDAndSend finds a context ID as FindContextID does, and sends
+// it to a VMM that does not inherit the vhost file descriptor, by writing it
+// to w encoded by encode. The context ID is released if it cannot be sent.
+func FindContextIDAndSend(w io.Writer, encode ContextIDEncoder) (*os.File, uint64, error) {
+	if w == nil || encode == nil {
+		return nil, 0, fmt.Errorf("A writer and an encoder must be specified")
+	}
+
+	vsockFd, cid, err := FindContextID()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := w.Write(encode(cid)); err != nil {
+		vsockFd.Close()
+		return nil, 0, fmt.Errorf("Could not send context ID %d: %v", cid, err)
+	}
+
+	return vsockFd, cid, nil
 }
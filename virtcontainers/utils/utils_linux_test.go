@@ -6,17 +6,28 @@
 package utils
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestFindContextID(t *testing.T) {
 	assert := assert.New(t)
 
+	var calls uint64
+	ioctlErr := errors.New("ioctl")
 	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
-		return errors.New("ioctl")
+		calls++
+		return ioctlErr
 	}
 
 	orgVHostVSockDevicePath := VHostVSockDevicePath
@@ -32,4 +43,674 @@ func TestFindContextID(t *testing.T) {
 	assert.Nil(f)
 	assert.Zero(cid)
 	assert.Error(err)
+
+	exhausted, ok := err.(*ContextIDExhaustedError)
+	assert.True(ok)
+	assert.Equal(calls, exhausted.Attempts)
+	assert.Equal(maxUInt-2, exhausted.Attempts)
+	assert.False(exhausted.Time.IsZero())
+}
+
+func TestFindContextIDAscending(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	// Context IDs 3 and 4 are already taken.
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls < 3 {
+			return errors.New("ioctl")
+		}
+		return nil
+	}
+
+	opts := DefaultContextIDOptions()
+	assert.True(opts.RandomStart)
+	opts.RandomStart = false
+
+	f, cid, err := FindContextIDWithOptions(opts)
+	assert.NoError(err)
+	assert.NotNil(f)
+	defer f.Close()
+	assert.Equal(uint64(5), cid)
+	assert.Equal(3, calls)
+}
+
+func TestCountFreeContextIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	// Every other context ID is taken.
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls%2 == 0 {
+			return errors.New("ioctl")
+		}
+		return nil
+	}
+
+	free, sampled, err := CountFreeContextIDs(10)
+	assert.NoError(err)
+	assert.Equal(10, sampled)
+	assert.Equal(5, free)
+	assert.Equal(10, calls)
+
+	_, _, err = CountFreeContextIDs(0)
+	assert.Error(err)
+
+	VHostVSockDevicePath = "/does/not/exist"
+	_, _, err = CountFreeContextIDs(10)
+	assert.Error(err)
+}
+
+func TestAuditHeldContextIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	// Context IDs are probed in order, every third one is held.
+	inUse := os.NewSyscallError("ioctl", syscall.EADDRINUSE)
+	var calls int
+	var usedFd uintptr
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		usedFd = fd
+		if calls%3 == 0 {
+			return inUse
+		}
+		return nil
+	}
+
+	held, err := AuditHeldContextIDs(context.Background(), []ContextIDRange{{3, 8}, {100, 102}})
+	assert.NoError(err)
+	assert.Equal([]uint64{5, 8, 102}, held)
+	assert.Equal(9, calls)
+
+	// The vhost file is closed, no context ID is held.
+	var st syscall.Stat_t
+	assert.Equal(syscall.EBADF, syscall.Fstat(int(usedFd), &st))
+
+	held, err = AuditHeldContextIDs(context.Background(), nil)
+	assert.NoError(err)
+	assert.Empty(held)
+
+	// Cancelled in the middle of the audit
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls == 10 {
+			cancel()
+		}
+		return nil
+	}
+	_, err = AuditHeldContextIDs(ctx, []ContextIDRange{{3, maxUInt}})
+	assert.Error(err)
+	assert.Equal(context.Canceled, errors.Cause(err))
+	assert.Equal(contextIDDeadlineCheck, calls)
+
+	// Already cancelled
+	calls = 0
+	_, err = AuditHeldContextIDs(ctx, []ContextIDRange{{3, 8}})
+	assert.Error(err)
+	assert.Zero(calls)
+
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return os.NewSyscallError("ioctl", syscall.ENOTTY)
+	}
+	_, err = AuditHeldContextIDs(context.Background(), []ContextIDRange{{3, 8}})
+	assert.Error(err)
+
+	_, err = AuditHeldContextIDs(nil, []ContextIDRange{{3, 8}})
+	assert.Error(err)
+
+	for _, r := range []ContextIDRange{{0, 8}, {2, 8}, {8, 3}, {3, maxUInt + 1}} {
+		_, err = AuditHeldContextIDs(context.Background(), []ContextIDRange{r})
+		assert.Error(err, "range %v", r)
+	}
+
+	VHostVSockDevicePath = "/does/not/exist"
+	_, err = AuditHeldContextIDs(context.Background(), []ContextIDRange{{3, 8}})
+	assert.Error(err)
+}
+
+func TestFindContextIDWorkers(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	orgMaxUInt := maxUInt
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+		maxUInt = orgMaxUInt
+	}()
+	VHostVSockDevicePath = "/dev/null"
+	maxUInt = uint64(1000002)
+
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return nil
+	}
+
+	opts := ContextIDOptions{
+		Workers: 4,
+		Worker:  2,
+	}
+
+	f, cid, err := FindContextIDWithOptions(opts)
+	assert.NoError(err)
+	f.Close()
+	assert.Equal(uint64(500003), cid)
+
+	// The last worker gets the end of the space.
+	opts.Worker = 3
+	opts.RandomStart = true
+	for i := 0; i < 10; i++ {
+		f, cid, err = FindContextIDWithOptions(opts)
+		assert.NoError(err)
+		f.Close()
+		assert.True(cid >= 750003 && cid <= maxUInt, "cid %d", cid)
+	}
+
+	opts.Worker = 4
+	_, _, err = FindContextIDWithOptions(opts)
+	assert.Error(err)
+
+	opts.Worker = -1
+	_, _, err = FindContextIDWithOptions(opts)
+	assert.Error(err)
+}
+
+func TestFindContextIDMaxContextID(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	var calls uint64
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		return errors.New("ioctl")
+	}
+
+	opts := DefaultContextIDOptions()
+	opts.MaxContextID = 1000
+
+	_, _, err := FindContextIDWithOptions(opts)
+	exhausted, ok := err.(*ContextIDExhaustedError)
+	assert.True(ok)
+	assert.Equal(uint64(998), exhausted.Attempts)
+	assert.Equal(uint64(998), calls)
+
+	// Worker sub-ranges come from the capped space.
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return nil
+	}
+	opts = ContextIDOptions{
+		MaxContextID: 1002,
+		Workers:      2,
+		Worker:       1,
+	}
+	f, cid, err := FindContextIDWithOptions(opts)
+	assert.NoError(err)
+	f.Close()
+	assert.Equal(uint64(503), cid)
+
+	opts.Workers = 2000
+	_, _, err = FindContextIDWithOptions(opts)
+	assert.Error(err)
+
+	opts = ContextIDOptions{MaxContextID: 2}
+	_, _, err = FindContextIDWithOptions(opts)
+	assert.Error(err)
+
+	// Too large maximums are clamped.
+	opts = ContextIDOptions{MaxContextID: 1 << 40}
+	max, err := opts.maxContextID()
+	assert.NoError(err)
+	assert.Equal(maxUInt, max)
+}
+
+func TestFindContextIDRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	var calls int
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls < 3 {
+			return errors.New("ioctl")
+		}
+		return nil
+	}
+
+	registry := NewContextIDRegistry()
+	opts := ContextIDOptions{
+		Registry: registry,
+		Name:     "web-7",
+	}
+	f, cid, err := FindContextIDWithOptions(opts)
+	assert.NoError(err)
+	f.Close()
+	assert.Equal(uint64(5), cid)
+
+	name, ok := registry.Name(cid)
+	assert.True(ok)
+	assert.Equal("web-7", name)
+	_, ok = registry.Name(3)
+	assert.False(ok)
+
+	// Nothing is registered on failure.
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return errors.New("ioctl")
+	}
+	opts.MaxContextID = 10
+	opts.Name = "web-8"
+	_, _, err = FindContextIDWithOptions(opts)
+	assert.Error(err)
+	name, _ = registry.Name(cid)
+	assert.Equal("web-7", name)
+}
+
+type testSpan struct {
+	name  string
+	ended bool
+}
+
+func (s *testSpan) End() {
+	s.ended = true
+}
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) StartSpan(name string) Span {
+	s := &testSpan{name: name}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+func TestFindContextIDTracer(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+		ContextIDTracer = nil
+	}()
+	VHostVSockDevicePath = "/dev/null"
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return nil
+	}
+
+	// No tracer
+	f, _, err := FindContextID()
+	assert.NoError(err)
+	f.Close()
+
+	tracer := &testTracer{}
+	ContextIDTracer = tracer
+
+	f, _, err = FindContextID()
+	assert.NoError(err)
+	f.Close()
+
+	assert.Len(tracer.spans, 1)
+	assert.Equal("FindContextID", tracer.spans[0].name)
+	assert.True(tracer.spans[0].ended)
+}
+
+func TestIsContextIDAvailable(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	ioctlErr := error(nil)
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return ioctlErr
+	}
+
+	ok, err := IsContextIDAvailable(3)
+	assert.NoError(err)
+	assert.True(ok)
+
+	ioctlErr = os.NewSyscallError("ioctl", syscall.EADDRINUSE)
+	ok, err = IsContextIDAvailable(3)
+	assert.NoError(err)
+	assert.False(ok)
+
+	ioctlErr = os.NewSyscallError("ioctl", syscall.ENOTTY)
+	_, err = IsContextIDAvailable(3)
+	assert.Error(err)
+
+	_, err = IsContextIDAvailable(2)
+	assert.Error(err)
+	_, err = IsContextIDAvailable(maxUInt + 1)
+	assert.Error(err)
+}
+
+func TestWaitForContextIDFree(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	// Freed after a few checks
+	calls := 0
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls < 3 {
+			return os.NewSyscallError("ioctl", syscall.EADDRINUSE)
+		}
+		return nil
+	}
+
+	err := WaitForContextIDFree(context.Background(), 42, time.Millisecond)
+	assert.NoError(err)
+	assert.Equal(3, calls)
+
+	// Never freed
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return os.NewSyscallError("ioctl", syscall.EADDRINUSE)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = WaitForContextIDFree(ctx, 42, time.Millisecond)
+	assert.Error(err)
+
+	assert.Error(WaitForContextIDFree(context.Background(), 42, 0))
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write")
+}
+
+func TestFindContextIDAndSend(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return nil
+	}
+
+	encode := func(cid uint64) []byte {
+		return []byte(fmt.Sprintf("cid=%d\n", cid))
+	}
+
+	var buf bytes.Buffer
+	f, cid, err := FindContextIDAndSend(&buf, encode)
+	assert.NoError(err)
+	assert.NotNil(f)
+	f.Close()
+	assert.Equal(fmt.Sprintf("cid=%d\n", cid), buf.String())
+
+	f, cid, err = FindContextIDAndSend(failingWriter{}, encode)
+	assert.Error(err)
+	assert.Nil(f)
+	assert.Zero(cid)
+
+	_, _, err = FindContextIDAndSend(&buf, nil)
+	assert.Error(err)
+	_, _, err = FindContextIDAndSend(nil, encode)
+	assert.Error(err)
+}
+
+func TestFindContextIDBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	orgScanBackoffSleep := scanBackoffSleep
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+		scanBackoffSleep = orgScanBackoffSleep
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return errors.New("ioctl")
+	}
+
+	var sleeps []time.Duration
+	scanBackoffSleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+
+	// Disabled by default.
+	opts := ContextIDOptions{MaxContextID: 102}
+	_, _, err := FindContextIDWithOptions(opts)
+	assert.Error(err)
+	assert.Empty(sleeps)
+
+	// 100 probes, one backoff every 10 of them.
+	opts.BackoffInterval = 10
+	opts.BackoffDelay = time.Millisecond
+	_, _, err = FindContextIDWithOptions(opts)
+	assert.Error(err)
+	assert.Len(sleeps, 10)
+	assert.Equal(time.Millisecond, sleeps[0])
+
+	// Both phases of the scan back off.
+	sleeps = nil
+	opts.RandomStart = true
+	_, _, err = FindContextIDWithOptions(opts)
+	assert.Error(err)
+	assert.Len(sleeps, 10)
+
+	sleeps = nil
+	opts.BackoffDelay = 0
+	_, _, err = FindContextIDWithOptions(opts)
+	assert.Error(err)
+	assert.Empty(sleeps)
+}
+
+func TestFindContextIDDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	var calls uint64
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		return errors.New("ioctl")
+	}
+
+	// Past deadline, nothing is probed.
+	_, _, err := FindContextIDDeadline(time.Now().Add(-time.Second))
+	assert.Error(err)
+	assert.Equal(context.DeadlineExceeded, errors.Cause(err))
+	assert.Zero(calls)
+
+	// The deadline passes mid-scan.
+	deadline := time.Now().Add(10 * time.Millisecond)
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls == 10 {
+			time.Sleep(time.Until(deadline) + 10*time.Millisecond)
+		}
+		return errors.New("ioctl")
+	}
+	_, _, err = FindContextIDDeadline(deadline)
+	assert.Error(err)
+	assert.Equal(context.DeadlineExceeded, errors.Cause(err))
+	assert.Zero(calls % contextIDDeadlineCheck)
+	assert.True(calls < maxUInt/2)
+
+	calls = 0
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls < 3000 {
+			return errors.New("ioctl")
+		}
+		return nil
+	}
+	f, cid, err := FindContextIDDeadline(time.Now().Add(time.Minute))
+	assert.NoError(err)
+	f.Close()
+	assert.True(cid >= firstContextID)
+}
+
+func TestFindContextIDHintFile(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/dev/null"
+
+	hints, err := ioutil.TempFile("", "hints")
+	assert.NoError(err)
+	defer os.Remove(hints.Name())
+	_, err = hints.WriteString("abc\n1\n\n 42 \n5000\n43\n-7\n")
+	assert.NoError(err)
+	hints.Close()
+
+	// 42 is taken, 5000 is beyond the maximum.
+	calls := 0
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls == 1 {
+			return errors.New("ioctl")
+		}
+		return nil
+	}
+
+	opts := ContextIDOptions{
+		MaxContextID: 1000,
+		HintFile:     hints.Name(),
+	}
+	f, cid, err := FindContextIDWithOptions(opts)
+	assert.NoError(err)
+	f.Close()
+	assert.Equal(uint64(43), cid)
+	assert.Equal(2, calls)
+
+	// Every hint is taken, the scan follows.
+	calls = 0
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if calls <= 2 {
+			return errors.New("ioctl")
+		}
+		return nil
+	}
+	f, cid, err = FindContextIDWithOptions(opts)
+	assert.NoError(err)
+	f.Close()
+	assert.Equal(firstContextID, cid)
+	assert.Equal(3, calls)
+
+	// Missing hint file, the scan starts right away and the first two
+	// context IDs are still taken.
+	calls = 0
+	opts.HintFile = "/does/not/exist"
+	f, cid, err = FindContextIDWithOptions(opts)
+	assert.NoError(err)
+	f.Close()
+	assert.Equal(firstContextID+2, cid)
+	assert.Equal(3, calls)
+}
+
+func TestCanIoctl(t *testing.T) {
+	assert := assert.New(t)
+
+	orgIoctlFunc := ioctlFunc
+	defer func() {
+		ioctlFunc = orgIoctlFunc
+	}()
+
+	ioctlFunc = Ioctl
+	assert.NoError(CanIoctl())
+
+	for _, test := range []struct {
+		err     error
+		blocked bool
+	}{
+		{nil, false},
+		{os.NewSyscallError("ioctl", syscall.ENOTTY), false},
+		{os.NewSyscallError("ioctl", syscall.EPERM), true},
+		{os.NewSyscallError("ioctl", syscall.EACCES), true},
+		{os.NewSyscallError("ioctl", syscall.ENOSYS), true},
+		{os.NewSyscallError("ioctl", syscall.EIO), false},
+	} {
+		ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+			return test.err
+		}
+
+		err := CanIoctl()
+		if test.err == nil || ioctlErrno(test.err) == syscall.ENOTTY {
+			assert.NoError(err, "%v", test.err)
+			continue
+		}
+
+		assert.Error(err, "%v", test.err)
+		assert.Equal(test.blocked, strings.Contains(err.Error(), "seccomp"), "%v", err)
+	}
 }
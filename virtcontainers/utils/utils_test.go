@@ -329,3 +329,59 @@ func TestValidCgroupPath(t *testing.T) {
 	assert.Equal(DefaultCgroupPath, ValidCgroupPath("./../"))
 	assert.Equal(filepath.Join(DefaultCgroupPath, "o / g"), ValidCgroupPath("o / m /../ g"))
 }
+
+func TestAtomicWriteFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "atomic")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	oldData := []byte(`{"version": 1}`)
+	newData := []byte(`{"version": 2, "ids": [3, 4, 5]}`)
+
+	assert.NoError(AtomicWriteFile(path, oldData, 0640))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal(oldData, data)
+
+	fi, err := os.Stat(path)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0640), fi.Mode().Perm())
+
+	// A writer crashing midway only leaves a partial temporary file
+	// behind, the target still holds the complete previous data.
+	partial := filepath.Join(dir, ".state.json.tmp123")
+	assert.NoError(ioutil.WriteFile(partial, newData[:10], 0600))
+
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal(oldData, data)
+
+	assert.NoError(AtomicWriteFile(path, newData, 0600))
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal(newData, data)
+
+	fi, err = os.Stat(path)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// The leftover is not touched, and no other temporary file remains.
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(entries, 2)
+
+	// A failed rename does not leave a temporary file behind.
+	target := filepath.Join(dir, "dir")
+	assert.NoError(os.MkdirAll(filepath.Join(target, "child"), 0755))
+	assert.Error(AtomicWriteFile(target, newData, 0600))
+
+	entries, err = ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(entries, 3)
+
+	assert.Error(AtomicWriteFile("", newData, 0600))
+	assert.Error(AtomicWriteFile(filepath.Join(dir, "does", "not", "exist"), newData, 0600))
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// VsockTransportVirtio is the virtio transport, provided on the host
+	// by vhost-vsock.
+	VsockTransportVirtio = "virtio"
+
+	// VsockTransportVMCI is the VMware VMCI transport.
+	VsockTransportVMCI = "vmci"
+
+	// VsockTransportHyperV is the Hyper-V sockets transport.
+	VsockTransportHyperV = "hyperv"
+
+	// VsockTransportNone means no vsock transport is available.
+	VsockTransportNone = "none"
+)
+
+// VSockDevicePath is the path of the vsock device, used by vsock
+// applications, notably from inside a guest.
+var VSockDevicePath = "/dev/vsock"
+
+// vhostVsockProbeContextID is the context ID used to probe the vhost-vsock
+// ioctl, the kernel always rejects it with EINVAL since it is reserved for
+// the host.
+const vhostVsockProbeContextID uint64 = 0x2
+
+var (
+	vhostVsockIoctlMutex     sync.Mutex
+	vhostVsockIoctlChecked   bool
+	vhostVsockIoctlSupported bool
+)
+
+// vsockTransportModules maps the kernel modules providing a vsock
+// transport to that transport, in detection order.
+var vsockTransportModules = []struct {
+	module    string
+	transport string
+}{
+	{"vhost_vsock", VsockTransportVirtio},
+	{"vmw_vsock_vmci_transport", VsockTransportVMCI},
+	{"hv_sock", VsockTransportHyperV},
+}
+
+// VsockTransport returns the vsock transport available on the host, one of
+// the VsockTransport constants. It is detected from the loaded kernel
+// modules, and from the vhost-vsock device for a built-in vhost-vsock.
+// Only the virtio transport lets FindContextID allocate context IDs.
+func VsockTransport() (string, error) {
+	for _, m := range vsockTransportModules {
+		_, err := os.Stat(filepath.Join(sysfsRoot, "module", m.module))
+		if err == nil {
+			return m.transport, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	if SupportsVsocks() {
+		return VsockTransportVirtio, nil
+	}
+
+	return VsockTransportNone, nil
+}
+
+// VsockDeviceDiag describes a vsock device node.
+type VsockDeviceDiag struct {
+	// Path is the path of the device node.
+	Path string
+
+	// Exists is true if the device node exists.
+	Exists bool
+
+	// Mode is the mode of the device node.
+	Mode os.FileMode
+
+	// CanOpen is true if the current user can open the device node
+	// for reading and writing.
+	CanOpen bool
+
+	// Err is the error that prevented checking or opening the
+	// device node.
+	Err error
+}
+
+// VsockDiag describes the vsock support of the host.
+type VsockDiag struct {
+	// VhostVsock describes the vhost-vsock device.
+	VhostVsock VsockDeviceDiag
+
+	// Vsock describes the vsock device.
+	Vsock VsockDeviceDiag
+
+	// Supported is true if vsocks are supported, see SupportsVsocks.
+	Supported bool
+
+	// Transport is the vsock transport, see VsockTransport.
+	Transport    string
+	TransportErr error
+
+	// IoctlSupported is true if the vhost-vsock device accepts the
+	// ioctl allocating context IDs, see VhostVsockIoctlSupported. No
+	// context ID is allocated to find out.
+	IoctlSupported bool
+	IoctlErr       error
+}
+
+// VsockDiagnostics reports on the vsock support of the host, e.g. for a
+// check command. Every check is done even if others fail, their errors
+// are reported in the returned VsockDiag and the returned error is always
+// nil.
+func VsockDiagnostics() (*VsockDiag, error) {
+	diag := &VsockDiag{
+		VhostVsock: vsockDeviceDiag(VHostVSockDevicePath),
+		Vsock:      vsockDeviceDiag(VSockDevicePath),
+		Supported:  SupportsVsocks(),
+	}
+
+	diag.Transport, diag.TransportErr = VsockTransport()
+	diag.IoctlSupported, diag.IoctlErr = probeVhostVsockIoctl()
+
+	return diag, nil
+}
+
+func vsockDeviceDiag(path string) VsockDeviceDiag {
+	diag := VsockDeviceDiag{
+		Path: path,
+	}
+
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return diag
+	} else if err != nil {
+		diag.Err = err
+		return diag
+	}
+
+	diag.Exists = true
+	diag.Mode = fi.Mode()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		diag.Err = err
+		return diag
+	}
+	f.Close()
+	diag.CanOpen = true
+
+	return diag
+}
+
+// VhostVsockIoctlSupported returns true if the vhost-vsock device accepts
+// the VHOST_VSOCK_SET_GUEST_CID ioctl, telling a working device from one
+// that exists on a kernel built without the feature. The probe asks for a
+// reserved context ID, so no context ID is ever held. Only conclusive
+// results are cached, an error means the probe should be retried.
+func VhostVsockIoctlSupported() (bool, error) {
+	vhostVsockIoctlMutex.Lock()
+	defer vhostVsockIoctlMutex.Unlock()
+
+	if vhostVsockIoctlChecked {
+		return vhostVsockIoctlSupported, nil
+	}
+
+	supported, err := probeVhostVsockIoctl()
+	if err != nil {
+		return false, err
+	}
+
+	vhostVsockIoctlSupported = supported
+	vhostVsockIoctlChecked = true
+	return vhostVsockIoctlSupported, nil
+}
+
+// probeVhostVsockIoctl issues a single VHOST_VSOCK_SET_GUEST_CID ioctl for
+// a reserved context ID, see VhostVsockIoctlSupported.
+func probeVhostVsockIoctl() (bool, error) {
+	vsockFd, err := os.OpenFile(VHostVSockDevicePath, syscall.O_RDWR, 0666)
+	if err != nil {
+		return false, err
+	}
+	defer vsockFd.Close()
+
+	cid := vhostVsockProbeContextID
+	err = ioctlFunc(vsockFd.Fd(), ioctlVhostVsockSetGuestCid, uintptr(unsafe.Pointer(&cid)))
+
+	switch errno := ioctlErrno(err); {
+	case err == nil, errno == syscall.EINVAL, errno == syscall.EADDRINUSE:
+		return true, nil
+	case errno == syscall.ENOTTY:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Could not probe %v: %v", VHostVSockDevicePath, err)
+	}
+}
+
+// GuestLocalContextID returns the context ID of the VM it runs in, as
+// assigned by the host, e.g. for the agent to know its own address. It is
+// meant to be used from inside a guest, through the vsock device: on the
+// host, context IDs are allocated to guests through the vhost-vsock device,
+// see FindContextID, and the local context ID is the one of the host.
+func GuestLocalContextID() (uint64, error) {
+	f, err := os.Open(VSockDevicePath)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not open vsock device to get the local context ID")
+	}
+	defer f.Close()
+
+	// The context ID is returned as an unsigned int.
+	var cid uint32
+	if err := ioctlFunc(f.Fd(), unix.IOCTL_VM_SOCKETS_GET_LOCAL_CID, uintptr(unsafe.Pointer(&cid))); err != nil {
+		return 0, errors.Wrapf(err, "Could not get the local context ID from %v", VSockDevicePath)
+	}
+
+	return uint64(cid), nil
+}
+
+// vhostVsockReady returns true once the vhost-vsock device is usable, and
+// an error if it will never be.
+// It is a variable so tests can replace it.
+var vhostVsockReady = func() (bool, error) {
+	if _, err := os.Stat(VHostVSockDevicePath); err != nil {
+		// The device node shows up once the module is loaded.
+		return false, nil
+	}
+
+	supported, err := VhostVsockIoctlSupported()
+	if err != nil {
+		// The device might not be initialized yet.
+		return false, nil
+	}
+
+	if !supported {
+		return false, fmt.Errorf("%v exists but does not support VHOST_VSOCK_SET_GUEST_CID", VHostVSockDevicePath)
+	}
+
+	return true, nil
+}
+
+// WaitForVsockModule waits about every interval for the vhost-vsock device
+// to be usable, e.g. while the vhost_vsock module is still being loaded at
+// boot time, until it is or ctx is done.
+func WaitForVsockModule(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("Invalid interval %v", interval)
+	}
+
+	err := RetryWithBackoff(ctx, interval, interval, vhostVsockReady)
+	if err != nil && err == ctx.Err() {
+		return fmt.Errorf("%v still not usable, is the vhost_vsock module loaded? %v", VHostVSockDevicePath, err)
+	}
+
+	return err
+}
@@ -0,0 +1,296 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestVsockTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	sysfs, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	defer func() {
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+	}()
+	VHostVSockDevicePath = "/does/not/exist"
+
+	transport, err := VsockTransport()
+	assert.NoError(err)
+	assert.Equal(VsockTransportNone, transport)
+
+	// Built-in vhost-vsock
+	VHostVSockDevicePath = "/dev/null"
+	transport, err = VsockTransport()
+	assert.NoError(err)
+	assert.Equal(VsockTransportVirtio, transport)
+	VHostVSockDevicePath = "/does/not/exist"
+
+	tests := []struct {
+		module    string
+		transport string
+	}{
+		{"hv_sock", VsockTransportHyperV},
+		{"vmw_vsock_vmci_transport", VsockTransportVMCI},
+		{"vhost_vsock", VsockTransportVirtio},
+	}
+
+	for _, test := range tests {
+		err := os.MkdirAll(filepath.Join(sysfs.root, "module", test.module), 0755)
+		assert.NoError(err)
+
+		transport, err := VsockTransport()
+		assert.NoError(err)
+		assert.Equal(test.transport, transport, test.module)
+	}
+}
+
+func TestVsockDiagnostics(t *testing.T) {
+	assert := assert.New(t)
+
+	_, cleanup := newTestSysfs(t)
+	defer cleanup()
+
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	orgVSockDevicePath := VSockDevicePath
+	orgIoctlFunc := ioctlFunc
+	defer func() {
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+		VSockDevicePath = orgVSockDevicePath
+		ioctlFunc = orgIoctlFunc
+	}()
+
+	var calls int
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		assert.Equal(uintptr(ioctlVhostVsockSetGuestCid), request)
+		return os.NewSyscallError("ioctl", syscall.EINVAL)
+	}
+
+	VHostVSockDevicePath = "/dev/null"
+	VSockDevicePath = "/does/not/exist"
+
+	diag, err := VsockDiagnostics()
+	assert.NoError(err)
+	assert.True(diag.VhostVsock.Exists)
+	assert.True(diag.VhostVsock.CanOpen)
+	assert.NoError(diag.VhostVsock.Err)
+	assert.True(diag.VhostVsock.Mode&os.ModeCharDevice != 0)
+	assert.Equal("/dev/null", diag.VhostVsock.Path)
+	assert.False(diag.Vsock.Exists)
+	assert.False(diag.Vsock.CanOpen)
+	assert.NoError(diag.Vsock.Err)
+	assert.True(diag.Supported)
+	assert.Equal(VsockTransportVirtio, diag.Transport)
+	assert.NoError(diag.TransportErr)
+	assert.True(diag.IoctlSupported)
+	assert.NoError(diag.IoctlErr)
+
+	// A single probe, no context ID is allocated.
+	assert.Equal(1, calls)
+
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return os.NewSyscallError("ioctl", syscall.ENOTTY)
+	}
+	diag, err = VsockDiagnostics()
+	assert.NoError(err)
+	assert.False(diag.IoctlSupported)
+	assert.NoError(diag.IoctlErr)
+
+	// Partial results
+	VHostVSockDevicePath = "/does/not/exist"
+	diag, err = VsockDiagnostics()
+	assert.NoError(err)
+	assert.False(diag.VhostVsock.Exists)
+	assert.False(diag.Supported)
+	assert.Equal(VsockTransportNone, diag.Transport)
+	assert.False(diag.IoctlSupported)
+	assert.Error(diag.IoctlErr)
+}
+
+func TestVhostVsockIoctlSupported(t *testing.T) {
+	assert := assert.New(t)
+
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	orgIoctlFunc := ioctlFunc
+	reset := func() {
+		vhostVsockIoctlChecked = false
+		vhostVsockIoctlSupported = false
+	}
+	defer func() {
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+		ioctlFunc = orgIoctlFunc
+		reset()
+	}()
+
+	VHostVSockDevicePath = "/does/not/exist"
+	reset()
+	_, err := VhostVsockIoctlSupported()
+	assert.Error(err)
+
+	VHostVSockDevicePath = "/dev/null"
+
+	var errno syscall.Errno
+	var calls int
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		calls++
+		if errno == 0 {
+			return nil
+		}
+		return os.NewSyscallError("ioctl", errno)
+	}
+
+	tests := []struct {
+		errno     syscall.Errno
+		supported bool
+		valid     bool
+	}{
+		{syscall.EINVAL, true, true},
+		{syscall.EADDRINUSE, true, true},
+		{0, true, true},
+		{syscall.ENOTTY, false, true},
+		{syscall.EFAULT, false, false},
+	}
+
+	for _, test := range tests {
+		reset()
+		errno = test.errno
+		supported, err := VhostVsockIoctlSupported()
+		if !test.valid {
+			assert.Error(err)
+			assert.False(vhostVsockIoctlChecked)
+			continue
+		}
+		assert.NoError(err)
+		assert.Equal(test.supported, supported, "%v", test.errno)
+	}
+
+	// The result is cached.
+	reset()
+	calls = 0
+	errno = syscall.ENOTTY
+	supported, err := VhostVsockIoctlSupported()
+	assert.NoError(err)
+	assert.False(supported)
+	errno = syscall.EINVAL
+	supported, err = VhostVsockIoctlSupported()
+	assert.NoError(err)
+	assert.False(supported)
+	assert.Equal(1, calls)
+}
+
+func TestGuestLocalContextID(t *testing.T) {
+	assert := assert.New(t)
+
+	orgVSockDevicePath := VSockDevicePath
+	orgIoctlFunc := ioctlFunc
+	defer func() {
+		VSockDevicePath = orgVSockDevicePath
+		ioctlFunc = orgIoctlFunc
+	}()
+
+	VSockDevicePath = "/does/not/exist"
+	_, err := GuestLocalContextID()
+	assert.Error(err)
+	assert.True(os.IsNotExist(errors.Cause(err)))
+
+	VSockDevicePath = "/dev/null"
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		assert.Equal(uintptr(unix.IOCTL_VM_SOCKETS_GET_LOCAL_CID), request)
+		return os.NewSyscallError("ioctl", syscall.ENOTTY)
+	}
+	_, err = GuestLocalContextID()
+	assert.Error(err)
+
+	// Outside of a guest, the vsock device reports the host context ID.
+	ioctlFunc = Ioctl
+	VSockDevicePath = orgVSockDevicePath
+	if _, err := os.Stat(VSockDevicePath); err != nil {
+		t.Skipf("%v not available", VSockDevicePath)
+	}
+	cid, err := GuestLocalContextID()
+	assert.NoError(err)
+	assert.NotZero(cid)
+}
+
+func TestWaitForVsockModule(t *testing.T) {
+	assert := assert.New(t)
+
+	orgVhostVsockReady := vhostVsockReady
+	defer func() {
+		vhostVsockReady = orgVhostVsockReady
+	}()
+
+	calls := 0
+	vhostVsockReady = func() (bool, error) {
+		calls++
+		return calls == 3, nil
+	}
+	assert.NoError(WaitForVsockModule(context.Background(), time.Millisecond))
+	assert.Equal(3, calls)
+
+	vhostVsockReady = func() (bool, error) {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := WaitForVsockModule(ctx, time.Millisecond)
+	assert.Error(err)
+	assert.Contains(err.Error(), "vhost_vsock")
+
+	// Unusable device, no need to wait.
+	vhostVsockReady = func() (bool, error) {
+		return false, errors.New("not supported")
+	}
+	assert.Error(WaitForVsockModule(context.Background(), time.Millisecond))
+
+	assert.Error(WaitForVsockModule(context.Background(), 0))
+}
+
+func TestVhostVsockReady(t *testing.T) {
+	assert := assert.New(t)
+
+	orgVHostVSockDevicePath := VHostVSockDevicePath
+	orgIoctlFunc := ioctlFunc
+	defer func() {
+		VHostVSockDevicePath = orgVHostVSockDevicePath
+		ioctlFunc = orgIoctlFunc
+		vhostVsockIoctlChecked = false
+	}()
+
+	VHostVSockDevicePath = "/does/not/exist"
+	ready, err := vhostVsockReady()
+	assert.NoError(err)
+	assert.False(ready)
+
+	VHostVSockDevicePath = "/dev/null"
+	vhostVsockIoctlChecked = false
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return os.NewSyscallError("ioctl", syscall.EINVAL)
+	}
+	ready, err = vhostVsockReady()
+	assert.NoError(err)
+	assert.True(ready)
+
+	vhostVsockIoctlChecked = false
+	ioctlFunc = func(fd uintptr, request, arg1 uintptr) error {
+		return os.NewSyscallError("ioctl", syscall.ENOTTY)
+	}
+	_, err = vhostVsockReady()
+	assert.Error(err)
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// Ports derived from service names, see VsockPortForService. The range
+// stays clear of the privileged ports, of the agent port (1024) and of
+// the ports commonly picked by hand below 10000.
+const (
+	// VsockServicePortMin is the first port given to services.
+	VsockServicePortMin uint32 = 10000
+
+	// VsockServicePortMax is the last port given to services.
+	VsockServicePortMax uint32 = 59999
+)
+
+// Vsock port constraints. They are hardcoded in the kernel, see
+// net/vmw_vsock/af_vsock.c, and cannot be detected: unlike IP, there is no
+// sysctl to change the privileged ports of vsock. Keeping the services
+// within [VsockServicePortMin, VsockServicePortMax] is a convention.
+const (
+	// VsockPrivilegedPortMax is the last privileged port: binding ports up
+	// to it takes CAP_NET_BIND_SERVICE in the guest.
+	VsockPrivilegedPortMax uint32 = 1023
+
+	// vsockPortAny is VMADDR_PORT_ANY, which asks bind(2) for any free
+	// port and cannot be listened on.
+	vsockPortAny uint32 = 0xFFFFFFFF
+)
+
+// ValidateVsockPort checks that port can be used by a guest service:
+// VMADDR_PORT_ANY is not a port, and the privileged ports are left to the
+// processes started with CAP_NET_BIND_SERVICE, which services should not
+// depend on.
+func ValidateVsockPort(port uint32) error {
+	if port == vsockPortAny {
+		return fmt.Errorf("Invalid vsock port %#x, it is VMADDR_PORT_ANY", port)
+	}
+
+	if port <= VsockPrivilegedPortMax {
+		return fmt.Errorf("Invalid vsock port %d, ports up to %d are privileged", port, VsockPrivilegedPortMax)
+	}
+
+	return nil
+}
+
+// VsockPortForService returns the vsock port of the guest service name,
+// derived from the FNV-1a hash of name so that every component agrees on
+// it without coordination. The port is always valid, see
+// ValidateVsockPort. Distinct names can get the same port, callers should
+// register the ports they use, see VsockPortRegistry, to detect collisions
+// and rename one of the services.
+func VsockPortForService(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	return VsockServicePortMin + h.Sum32()%(VsockServicePortMax-VsockServicePortMin+1)
+}
+
+// VsockPortRegistry maps vsock ports to the services using them. A
+// VsockPortRegistry is safe for concurrent use, and its zero value is ready
+// to be used.
+type VsockPortRegistry struct {
+	mu    sync.RWMutex
+	names map[uint32]string
+}
+
+// NewVsockPortRegistry returns an empty VsockPortRegistry.
+func NewVsockPortRegistry() *VsockPortRegistry {
+	return &VsockPortRegistry{}
+}
+
+// Register associates name to port. Unlike ContextIDRegistry.Register, it
+// fails if port is already used by another service, since two services
+// cannot listen on the same port, or if port is not valid, see
+// ValidateVsockPort.
+func (r *VsockPortRegistry) Register(port uint32, name string) error {
+	if err := ValidateVsockPort(port); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if current, ok := r.names[port]; ok && current != name {
+		return fmt.Errorf("Vsock port %d of service %s already used by service %s", port, name, current)
+	}
+
+	if r.names == nil {
+		r.names = make(map[uint32]string)
+	}
+	r.names[port] = name
+
+	return nil
+}
+
+// RegisterService registers the service name on its port, as returned by
+// VsockPortForService, and returns that port.
+func (r *VsockPortRegistry) RegisterService(name string) (uint32, error) {
+	port := VsockPortForService(name)
+	if err := r.Register(port, name); err != nil {
+		return 0, err
+	}
+
+	return port, nil
+}
+
+// Name returns the service using port, and whether there is one.
+func (r *VsockPortRegistry) Name(port uint32) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name, ok := r.names[port]
+	return name, ok
+}
+
+// Unregister removes the service using port.
+func (r *VsockPortRegistry) Unregister(port uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.names, port)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVsockPortForService(t *testing.T) {
+	assert := assert.New(t)
+
+	// The ports must never change.
+	assert.Equal(uint32(10742), VsockPortForService("agent"))
+	assert.Equal(uint32(13832), VsockPortForService("shim"))
+
+	for i := 0; i < 1000; i++ {
+		port := VsockPortForService(fmt.Sprintf("service-%d", i))
+		assert.True(port >= VsockServicePortMin && port <= VsockServicePortMax)
+		assert.NoError(ValidateVsockPort(port))
+	}
+}
+
+func TestValidateVsockPort(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, port := range []uint32{1024, VsockServicePortMin, VsockServicePortMax, 0xFFFFFFFE} {
+		assert.NoError(ValidateVsockPort(port), "port %d", port)
+	}
+
+	for _, port := range []uint32{0, 1, 22, VsockPrivilegedPortMax, 0xFFFFFFFF} {
+		assert.Error(ValidateVsockPort(port), "port %d", port)
+	}
+}
+
+func TestVsockPortRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	var r VsockPortRegistry
+
+	port, err := r.RegisterService("agent")
+	assert.NoError(err)
+	assert.Equal(VsockPortForService("agent"), port)
+
+	name, ok := r.Name(port)
+	assert.True(ok)
+	assert.Equal("agent", name)
+
+	// Registering again is fine.
+	_, err = r.RegisterService("agent")
+	assert.NoError(err)
+
+	// svc-1782 and svc-2800 collide.
+	assert.Equal(VsockPortForService("svc-1782"), VsockPortForService("svc-2800"))
+	_, err = r.RegisterService("svc-1782")
+	assert.NoError(err)
+	_, err = r.RegisterService("svc-2800")
+	assert.Error(err)
+
+	assert.Error(r.Register(port, "other"))
+	r.Unregister(port)
+	_, ok = r.Name(port)
+	assert.False(ok)
+	assert.NoError(r.Register(port, "other"))
+
+	assert.Error(r.Register(22, "ssh"))
+	_, ok = r.Name(22)
+	assert.False(ok)
+}
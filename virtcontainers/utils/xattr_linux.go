@@ -0,0 +1,54 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxXattrAttempts bounds the retries of GetXattr when the attribute keeps
+// growing between getting its size and reading it.
+const maxXattrAttempts = 5
+
+// GetXattr returns the value of the extended attribute name of path, e.g.
+// "security.selinux". Symbolic links are followed.
+func GetXattr(path, name string) ([]byte, error) {
+	for i := 0; i < maxXattrAttempts; i++ {
+		size, err := unix.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr " + name, Path: path, Err: err}
+		}
+
+		if size == 0 {
+			return []byte{}, nil
+		}
+
+		// ERANGE means the value grew after its size was read.
+		value := make([]byte, size)
+		size, err = unix.Getxattr(path, name, value)
+		if err == unix.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, &os.PathError{Op: "getxattr " + name, Path: path, Err: err}
+		}
+
+		return value[:size], nil
+	}
+
+	return nil, &os.PathError{Op: "getxattr " + name, Path: path, Err: unix.ERANGE}
+}
+
+// SetXattr sets the extended attribute name of path to value, creating it
+// if needed. Symbolic links are followed.
+func SetXattr(path, name string, value []byte) error {
+	if err := unix.Setxattr(path, name, value, 0); err != nil {
+		return &os.PathError{Op: "setxattr " + name, Path: path, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXattr(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "xattr")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// Prefer a tmpfs, which supports user.* attributes since Linux 6.6.
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", 0, ""); err == nil {
+		defer syscall.Unmount(dir, syscall.MNT_DETACH)
+	}
+
+	path := filepath.Join(dir, "file")
+	assert.NoError(ioutil.WriteFile(path, nil, 0644))
+
+	err = SetXattr(path, "user.test", []byte("value"))
+	if isErrno(err, syscall.ENOTSUP) {
+		t.Skip("user.* extended attributes not supported")
+	}
+	assert.NoError(err)
+
+	value, err := GetXattr(path, "user.test")
+	assert.NoError(err)
+	assert.Equal([]byte("value"), value)
+
+	// Large values are read whole.
+	large := bytes.Repeat([]byte("x"), 3000)
+	assert.NoError(SetXattr(path, "user.test", large))
+	value, err = GetXattr(path, "user.test")
+	assert.NoError(err)
+	assert.Equal(large, value)
+
+	assert.NoError(SetXattr(path, "user.empty", nil))
+	value, err = GetXattr(path, "user.empty")
+	assert.NoError(err)
+	assert.Empty(value)
+
+	_, err = GetXattr(path, "user.missing")
+	assert.Error(err)
+	assert.True(isErrno(err, syscall.ENODATA), "%v", err)
+
+	_, err = GetXattr(filepath.Join(dir, "missing"), "user.test")
+	assert.True(os.IsNotExist(err))
+
+	assert.Error(SetXattr(filepath.Join(dir, "missing"), "user.test", nil))
+}
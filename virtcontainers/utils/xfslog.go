@@ -0,0 +1,213 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrRecoveryStateUnknown is returned by NeedsRecovery when the state of
+// the filesystem cannot be found out, e.g. for an XFS filesystem whose log
+// is on another device.
+var ErrRecoveryStateUnknown = errors.New("Recovery state of the filesystem is unknown")
+
+// XFS log, see <fs/xfs/libxfs/xfs_log_format.h>. The log is made of 512
+// bytes basic blocks, whose first word is overwritten with the cycle
+// number, the number of times the log wrapped, when written.
+const (
+	xfsLogBBSize = 512
+
+	xlogHeaderMagic     = 0xFEEDBABE
+	xlogVersion2        = 0x2
+	xlogHeaderCycleSize = 32 * 1024
+	xlogUnmountTrans    = 0x20
+
+	// xlog_rec_header fields
+	xlogCycleOffset     = 4
+	xlogVersionOffset   = 8
+	xlogLenOffset       = 12
+	xlogNumLogOpsOffset = 40
+	xlogSizeOffset      = 320
+
+	// oh_flags of xlog_op_header
+	xlogOpFlagsOffset = 9
+)
+
+// xfsLog reads the basic blocks of an internal XFS log.
+type xfsLog struct {
+	r      io.ReaderAt
+	offset int64
+	blocks int64
+}
+
+// block returns the basic block bb of the log, which wraps.
+func (l *xfsLog) block(bb int64) ([]byte, error) {
+	buf := make([]byte, xfsLogBBSize)
+	_, err := l.r.ReadAt(buf, l.offset+(bb%l.blocks)*xfsLogBBSize)
+	return buf, err
+}
+
+// cycle returns the cycle number of the basic block bb, which record
+// headers hold after their magic number.
+func (l *xfsLog) cycle(bb int64) (uint32, error) {
+	buf, err := l.block(bb)
+	if err != nil {
+		return 0, err
+	}
+
+	be := binary.BigEndian
+	if be.Uint32(buf) == xlogHeaderMagic {
+		return be.Uint32(buf[xlogCycleOffset:]), nil
+	}
+
+	return be.Uint32(buf), nil
+}
+
+// head returns the basic block following the last one written, found like
+// xlog_find_head does: it is the first block of a lower cycle than the
+// first block. Torn writes of the last records are not looked for.
+func (l *xfsLog) head() (int64, error) {
+	first, err := l.cycle(0)
+	if err != nil {
+		return 0, err
+	}
+
+	last, err := l.cycle(l.blocks - 1)
+	if err != nil {
+		return 0, err
+	}
+
+	if first == last {
+		// The log was written up to its end.
+		return l.blocks, nil
+	}
+
+	lo, hi := int64(0), l.blocks-1
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		c, err := l.cycle(mid)
+		if err != nil {
+			return 0, err
+		}
+
+		if c == last {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	return hi, nil
+}
+
+// openXFSLog returns the internal log of the XFS filesystem starting at
+// offset in r, or ErrRecoveryStateUnknown if the log is external.
+func openXFSLog(r io.ReaderAt, offset int64) (*xfsLog, error) {
+	sb := make([]byte, xfsSuperblockSize)
+	if _, err := r.ReadAt(sb, offset); err != nil {
+		return nil, err
+	}
+
+	be := binary.BigEndian
+	blockSize := int64(be.Uint32(sb[xfsBlockSizeOffset:]))
+	agBlocks := int64(be.Uint32(sb[xfsAGBlocksOffset:]))
+	agBlkLog := uint(sb[xfsAGBlkLogOffset])
+	logStart := be.Uint64(sb[xfsLogStartOffset:])
+	logBlocks := int64(be.Uint32(sb[xfsLogBlocksOffset:]))
+
+	if blockSize < xfsLogBBSize || blockSize > 64*1024 || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("Invalid XFS block size %d", blockSize)
+	}
+
+	if logStart == 0 {
+		return nil, ErrRecoveryStateUnknown
+	}
+
+	if agBlkLog >= 32 || logBlocks == 0 {
+		return nil, fmt.Errorf("Invalid XFS log geometry")
+	}
+
+	// sb_logstart is a filesystem block number, made of the allocation
+	// group number and of the block number in that group.
+	agNumber := int64(logStart >> agBlkLog)
+	agBlock := int64(logStart & (1<<agBlkLog - 1))
+
+	return &xfsLog{
+		r:      r,
+		offset: offset + (agNumber*agBlocks+agBlock)*blockSize,
+		blocks: logBlocks * blockSize / xfsLogBBSize,
+	}, nil
+}
+
+// xfsLogDirty returns true if the internal log of the XFS filesystem
+// starting at offset in r needs to be replayed, i.e. if the last record
+// written is not an unmount record, as xlog_check_unmount_rec checks. A
+// zeroed log is clean.
+func xfsLogDirty(r io.ReaderAt, offset int64) (bool, error) {
+	log, err := openXFSLog(r, offset)
+	if err != nil {
+		return false, err
+	}
+
+	head, err := log.head()
+	if err != nil {
+		return false, err
+	}
+
+	first, err := log.cycle(0)
+	if err != nil {
+		return false, err
+	}
+	if first == 0 && head == log.blocks {
+		// Never written.
+		return false, nil
+	}
+
+	// Look for the header of the last record, before the head.
+	var header []byte
+	var headerBB int64
+	for i := int64(1); i <= log.blocks; i++ {
+		bb := (head - i + log.blocks) % log.blocks
+		buf, err := log.block(bb)
+		if err != nil {
+			return false, err
+		}
+
+		if binary.BigEndian.Uint32(buf) == xlogHeaderMagic {
+			header, headerBB = buf, bb
+			break
+		}
+	}
+	if header == nil {
+		return false, fmt.Errorf("No record found in the XFS log")
+	}
+
+	be := binary.BigEndian
+
+	// Large log buffers have extended headers.
+	headerBlocks := int64(1)
+	if be.Uint32(header[xlogVersionOffset:])&xlogVersion2 != 0 {
+		if size := int64(be.Uint32(header[xlogSizeOffset:])); size > xlogHeaderCycleSize {
+			headerBlocks = (size + xlogHeaderCycleSize - 1) / xlogHeaderCycleSize
+		}
+	}
+
+	recordBlocks := (int64(be.Uint32(header[xlogLenOffset:])) + xfsLogBBSize - 1) / xfsLogBBSize
+	if (headerBB+headerBlocks+recordBlocks)%log.blocks != head%log.blocks ||
+		be.Uint32(header[xlogNumLogOpsOffset:]) != 1 {
+		return true, nil
+	}
+
+	data, err := log.block(headerBB + headerBlocks)
+	if err != nil {
+		return false, err
+	}
+
+	return data[xlogOpFlagsOffset]&xlogUnmountTrans == 0, nil
+}
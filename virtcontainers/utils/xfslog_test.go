@@ -0,0 +1,147 @@
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Geometry of the images returned by testXFSImage: 4096 bytes blocks,
+// allocation groups of 64 blocks, and a log of 16 blocks starting at block
+// 16, i.e. 128 basic blocks.
+const (
+	testXFSBlockSize = 4096
+	testXFSLogStart  = 16
+	testXFSLogBlocks = 16
+	testXFSLogBBs    = testXFSLogBlocks * testXFSBlockSize / xfsLogBBSize
+)
+
+// testXFSRecord describes a log record of one operation written by
+// testXFSImage, taking two basic blocks.
+type testXFSRecord struct {
+	bb      int
+	cycle   uint32
+	unmount bool
+}
+
+// testXFSImage returns an XFS image, with an external log if logStart is
+// 0, whose log holds the records written in order.
+func testXFSImage(logStart uint64, records ...testXFSRecord) []byte {
+	img := make([]byte, (testXFSLogStart+testXFSLogBlocks)*testXFSBlockSize)
+	be := binary.BigEndian
+
+	copy(img, xfsMagic)
+	be.PutUint32(img[xfsBlockSizeOffset:], testXFSBlockSize)
+	be.PutUint64(img[xfsLogStartOffset:], logStart)
+	be.PutUint32(img[xfsAGBlocksOffset:], 64)
+	be.PutUint32(img[xfsLogBlocksOffset:], testXFSLogBlocks)
+	img[xfsAGBlkLogOffset] = 6
+
+	log := img[testXFSLogStart*testXFSBlockSize:]
+	block := func(bb int) []byte {
+		bb %= testXFSLogBBs
+		return log[bb*xfsLogBBSize : (bb+1)*xfsLogBBSize]
+	}
+
+	for _, r := range records {
+		header := block(r.bb)
+		be.PutUint32(header, xlogHeaderMagic)
+		be.PutUint32(header[xlogCycleOffset:], r.cycle)
+		be.PutUint32(header[xlogVersionOffset:], xlogVersion2)
+		be.PutUint32(header[xlogLenOffset:], xfsLogBBSize)
+		be.PutUint32(header[xlogSizeOffset:], xlogHeaderCycleSize)
+
+		// Blocks written after the log wrapped are in the next cycle.
+		data := block(r.bb + 1)
+		if r.bb+1 < testXFSLogBBs {
+			be.PutUint32(data, r.cycle)
+		} else {
+			be.PutUint32(data, r.cycle+1)
+		}
+		if r.unmount {
+			be.PutUint32(header[xlogNumLogOpsOffset:], 1)
+			data[xlogOpFlagsOffset] = xlogUnmountTrans
+		} else {
+			be.PutUint32(header[xlogNumLogOpsOffset:], 2)
+			data[xlogOpFlagsOffset] = 0
+		}
+	}
+
+	return img
+}
+
+// testXFSCycle returns the records filling the log in cycle.
+func testXFSCycle(cycle uint32) []testXFSRecord {
+	var records []testXFSRecord
+	for bb := 0; bb < testXFSLogBBs; bb += 2 {
+		records = append(records, testXFSRecord{bb, cycle, false})
+	}
+	return records
+}
+
+func TestXFSLogDirty(t *testing.T) {
+	assert := assert.New(t)
+
+	wrapped := testXFSCycle(1)
+	wrapped[len(wrapped)-1].unmount = true
+
+	tests := []struct {
+		records  []testXFSRecord
+		expected bool
+	}{
+		// Zeroed log
+		{nil, false},
+		{[]testXFSRecord{{0, 1, true}}, false},
+		{[]testXFSRecord{{0, 1, false}}, true},
+		{[]testXFSRecord{{0, 1, true}, {2, 1, false}}, true},
+		{[]testXFSRecord{{0, 1, false}, {2, 1, true}}, false},
+		// Log written up to its end
+		{wrapped, false},
+		{testXFSCycle(1), true},
+		// Log wrapped
+		{append(testXFSCycle(1), testXFSRecord{0, 2, false}, testXFSRecord{2, 2, true}), false},
+		{append(wrapped, testXFSRecord{0, 2, true}, testXFSRecord{2, 2, false}), true},
+		// Record wrapping around the end of the log
+		{append(testXFSCycle(1), testXFSRecord{testXFSLogBBs - 1, 1, true}), false},
+		{append(wrapped, testXFSRecord{testXFSLogBBs - 1, 1, false}), true},
+	}
+
+	for i, test := range tests {
+		img := testXFSImage(testXFSLogStart, test.records...)
+
+		dirty, err := xfsLogDirty(bytes.NewReader(img), 0)
+		assert.NoError(err, "test %d", i)
+		assert.Equal(test.expected, dirty, "test %d", i)
+	}
+
+	// External log
+	img := testXFSImage(0)
+	_, err := xfsLogDirty(bytes.NewReader(img), 0)
+	assert.Equal(ErrRecoveryStateUnknown, err)
+
+	// No record header
+	img = testXFSImage(testXFSLogStart)
+	for bb := 0; bb < testXFSLogBBs; bb++ {
+		binary.BigEndian.PutUint32(img[testXFSLogStart*testXFSBlockSize+bb*xfsLogBBSize:], 1)
+	}
+	_, err = xfsLogDirty(bytes.NewReader(img), 0)
+	assert.Error(err)
+
+	// Invalid block size
+	img = testXFSImage(testXFSLogStart)
+	binary.BigEndian.PutUint32(img[xfsBlockSizeOffset:], 1000)
+	_, err = xfsLogDirty(bytes.NewReader(img), 0)
+	assert.Error(err)
+
+	// Truncated log
+	img = testXFSImage(testXFSLogStart, testXFSRecord{0, 1, true})
+	_, err = xfsLogDirty(bytes.NewReader(img[:testXFSLogStart*testXFSBlockSize]), 0)
+	assert.Error(err)
+}